@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// limits on uncertainty sampling requests, the pool is predicted in chunks of
+// uncertainChunk rows
+const (
+	defaultUncertainRows = 10
+	maxUncertainRows     = 1000
+	uncertainChunk       = 10000
+)
+
+// uncertainty strategies score the predicted probabilities of a row, higher
+// scores are more uncertain
+var uncertaintyStrategies = map[string]func(probs map[string]float64) float64{
+	// one minus the probability of the most likely label
+	"least_confidence": func(probs map[string]float64) float64 {
+		first, _ := topTwo(probs)
+		return 1 - first
+	},
+	// one minus the difference between the two most likely labels
+	"margin": func(probs map[string]float64) float64 {
+		first, second := topTwo(probs)
+		return 1 - (first - second)
+	},
+	// the entropy of the predicted probabilities, in nats
+	"entropy": func(probs map[string]float64) float64 {
+		var h float64
+		for _, p := range probs {
+			if p > 0 {
+				h -= p * math.Log(p)
+			}
+		}
+		return h
+	},
+}
+
+// UncertainReq selects the rows of an unlabeled pool to label, the N rows the
+// model is least certain of by the strategy, see uncertaintyStrategies. The
+// pool is uploaded with the request or is a file stored in the -pool-path
+// directory.
+type UncertainReq struct {
+	Strategy string
+	N        int
+	Pool     string
+}
+
+// Batch is a set of rows selected for labeling, each row is saved as a
+// prediction of the model so labels can be sent as feedback, see
+// Model.AddFeedback. Batches are saved in <model_id>.batches.json.
+type Batch struct {
+	ID            string    `json:"batch_id"`
+	ModelID       string    `json:"model_id"`
+	Date          time.Time `json:"created_at"`
+	Strategy      string    `json:"strategy"`
+	Pool          string    `json:"pool,omitempty"` // the stored pool, empty for uploaded data
+	PoolRows      int       `json:"pool_rows"`
+	PredictionIDs []string  `json:"prediction_ids"`
+	Labeled       int       `json:"labeled"` // rows with feedback, counted when the batch is read
+}
+
+// UncertainRow is a row selected for labeling, Row is its position in the pool
+type UncertainRow struct {
+	PredictionID string                 `json:"prediction_id"`
+	Row          int                    `json:"row"`
+	Score        float64                `json:"score"`
+	Labels       map[string]float64     `json:"labels"`
+	Data         map[string]interface{} `json:"data"`
+}
+
+// ParseUncertainReq reads the strategy, n, and pool query parameters,
+// defaulting to the 10 rows with the least confidence
+func ParseUncertainReq(query url.Values) (UncertainReq, error) {
+	req := UncertainReq{
+		Strategy: "least_confidence",
+		N:        defaultUncertainRows,
+		Pool:     strings.TrimSpace(query.Get("pool")),
+	}
+	if val := strings.TrimSpace(query.Get("strategy")); val != "" {
+		req.Strategy = val
+	}
+	if _, ok := uncertaintyStrategies[req.Strategy]; !ok {
+		return UncertainReq{}, fmt.Errorf("mlserver: unknown strategy %q, should be least_confidence, margin, or entropy", req.Strategy)
+	}
+	if val := strings.TrimSpace(query.Get("n")); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > maxUncertainRows {
+			return UncertainReq{}, fmt.Errorf("mlserver: n should be between 1 and %d", maxUncertainRows)
+		}
+		req.N = n
+	}
+	if req.Pool != "" && (req.Pool != filepath.Base(req.Pool) || strings.HasPrefix(req.Pool, ".")) {
+		return UncertainReq{}, errors.New("mlserver: pool should be the name of a file in the pool directory")
+	}
+	return req, nil
+}
+
+// Pool calls fn with each chunk of an unlabeled pool, at most uncertainChunk
+// rows parsed with keepInput set, see readPool and uploadedPool
+type Pool func(fn func(d ModelReq) error) error
+
+// PoolError is a problem reading an unlabeled pool, rather than predicting it
+type PoolError struct {
+	Err error
+}
+
+func (e PoolError) Error() string { return e.Err.Error() }
+
+// readPool returns a stored pool, read in chunks as it is predicted so only a
+// chunk of the pool is in memory at a time. The format is determined by the
+// file extension, see formatFromFileName, and gzip compressed files are
+// decompressed. Delimited text is read with the dialect of the model, except
+// tsv pools are tab separated.
+func readPool(dir, name string, s Schema) Pool {
+	return func(fn func(d ModelReq) error) error {
+		f, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("mlserver: pool %s not found", name)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := maybeGunzip(f)
+		if err != nil {
+			return err
+		}
+		format := formatFromFileName(name)
+		s.Dialect, err = readDialect(s.Dialect, format, nil)
+		if err != nil {
+			return err
+		}
+		s.keepInput = true
+
+		var d ModelReq
+		flush := func() error {
+			s.Apply(&d)
+			err := fn(d)
+			d = ModelReq{}
+			return err
+		}
+		err = eachRow(r, format, s, func(row map[string]interface{}) error {
+			d.Data = append(d.Data, row)
+			if len(d.Data) < uncertainChunk {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil && len(d.Data) > 0 {
+			err = flush()
+		}
+		return err
+	}
+}
+
+// uploadedPool returns a pool parsed from a request with keepInput set, in
+// chunks of uncertainChunk rows
+func uploadedPool(d ModelReq) Pool {
+	return func(fn func(d ModelReq) error) error {
+		for start := 0; start < len(d.Data); start += uncertainChunk {
+			end := start + uncertainChunk
+			if end > len(d.Data) {
+				end = len(d.Data)
+			}
+			err := fn(ModelReq{Data: d.Data[start:end], input: d.input[start:end]})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// MostUncertain predicts every row of the pool and returns the n rows scoring
+// highest by the strategy, most uncertain first. Only the n most uncertain rows
+// seen so far are kept as the pool is read. The selected rows are saved as
+// predictions of the model and the batch is saved with the model. Errors
+// reading the pool, including a pool without rows, are returned as a
+// PoolError.
+func (m *Model) MostUncertain(pool Pool, req UncertainReq) (Batch, []UncertainRow, error) {
+	score := uncertaintyStrategies[req.Strategy]
+	var rows []UncertainRow
+	n := 0
+	var predictErr error
+	err := pool(func(d ModelReq) error {
+		pred := m.Predict(ModelReq{ModelID: m.ID, Data: d.Data})
+		if len(pred.Labels) != len(d.Data) {
+			predictErr = fmt.Errorf("mlserver: model returned %d predictions for %d rows", len(pred.Labels), len(d.Data))
+			return predictErr
+		}
+		for i, p := range pred.Labels {
+			rows = append(rows, UncertainRow{Row: n + i, Score: score(p), Labels: p, Data: d.input[i]})
+		}
+		n += len(d.Data)
+
+		sort.Sort(byUncertainty(rows))
+		if len(rows) > req.N {
+			rows = rows[:req.N]
+		}
+		return nil
+	})
+	if err == nil && n == 0 {
+		err = errors.New("mlserver: pool has no rows")
+	}
+	if err != nil && err != predictErr {
+		err = PoolError{err}
+	}
+	if err != nil {
+		return Batch{}, nil, err
+	}
+
+	selected := Prediction{Labels: make([]map[string]float64, len(rows))}
+	input := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		selected.Labels[i] = row.Labels
+		input[i] = row.Data
+	}
+	err = m.savePredictions(&selected, input, time.Now().UTC())
+	if err != nil {
+		return Batch{}, nil, err
+	}
+	for i := range rows {
+		rows[i].PredictionID = selected.IDs[i]
+	}
+
+	b := Batch{
+		ID:            uuid.New(),
+		ModelID:       m.ID,
+		Date:          time.Now().UTC(),
+		Strategy:      req.Strategy,
+		Pool:          req.Pool,
+		PoolRows:      n,
+		PredictionIDs: selected.IDs,
+	}
+
+	m.feedbackLock.Lock()
+	defer m.feedbackLock.Unlock()
+
+	batches := []Batch{}
+	err = readJSONFile(m.batchesPath(), &batches)
+	if err != nil && !os.IsNotExist(err) {
+		return Batch{}, nil, err
+	}
+	err = writeJSONFile(m.batchesPath(), append(batches, b))
+	if err == nil {
+		err = m.persist(filepath.Base(m.batchesPath()))
+	}
+	return b, rows, err
+}
+
+// Batches returns the batches of rows selected for labeling, oldest first, with
+// the number of rows of each that received feedback
+func (m *Model) Batches() ([]Batch, error) {
+	batches := []Batch{}
+	err := readJSONFile(m.batchesPath(), &batches)
+	if os.IsNotExist(err) {
+		return batches, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := m.Feedback()
+	if err != nil {
+		return nil, err
+	}
+	labeled := make(map[string]bool, len(records))
+	for _, rec := range records {
+		labeled[rec.ID] = true
+	}
+	for i, b := range batches {
+		for _, id := range b.PredictionIDs {
+			if labeled[id] {
+				batches[i].Labeled++
+			}
+		}
+	}
+	return batches, nil
+}
+
+func (m *Model) batchesPath() string {
+	return filepath.Join(m.dir, m.ID+".batches.json")
+}
+
+// topTwo returns the two highest probabilities
+func topTwo(probs map[string]float64) (float64, float64) {
+	var first, second float64
+	for _, p := range probs {
+		if p > first {
+			first, second = p, first
+		} else if p > second {
+			second = p
+		}
+	}
+	return first, second
+}
+
+// byUncertainty sorts rows by decreasing score, ties are ordered by row
+type byUncertainty []UncertainRow
+
+func (s byUncertainty) Len() int      { return len(s) }
+func (s byUncertainty) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byUncertainty) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].Row < s[j].Row
+}
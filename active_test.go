@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writePool writes a pool file to dir, gzip compressed when name ends in .gz
+func writePool(t *testing.T, dir, name, data string) {
+	b := []byte(data)
+	if strings.HasSuffix(name, ".gz") {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		b = buf.Bytes()
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadPoolDialect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mlserver-pools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := Schema{
+		Target:  "label",
+		Types:   map[string]string{"x": typeNumeric, "c": typeCategorical},
+		Dialect: Dialect{Delimiter: ";"},
+	}
+	writePool(t, dir, "fit.csv", "x;c\n1,5;red\n")
+	writePool(t, dir, "tabs.tsv.gz", "x\tc\n1,5\tred\n")
+	writePool(t, dir, "rows.ndjson", `{"x": 1.5, "c": "red"}`+"\n")
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"fit.csv", map[string]interface{}{"x": "1,5", "c": "red"}},
+		{"tabs.tsv.gz", map[string]interface{}{"x": "1,5", "c": "red"}},
+		{"rows.ndjson", map[string]interface{}{"x": 1.5, "c": "red"}},
+	}
+
+	for _, tt := range tests {
+		var input []map[string]interface{}
+		err := readPool(dir, tt.name, s)(func(d ModelReq) error {
+			input = append(input, d.input...)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(input) != 1 || !reflect.DeepEqual(input[0], tt.data) {
+			t.Errorf("%s: rows %v, want %v", tt.name, input, tt.data)
+		}
+	}
+
+	err = readPool(dir, "missing.csv", s)(func(d ModelReq) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "pool missing.csv not found") {
+		t.Errorf("missing pool: error %v", err)
+	}
+}
+
+func TestReadPoolChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mlserver-pools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	buf.WriteString("x\n")
+	rows := 2*uncertainChunk + 5
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&buf, "%d\n", i)
+	}
+	writePool(t, dir, "big.csv", buf.String())
+
+	s := Schema{Types: map[string]string{"x": typeNumeric}}
+	var sizes []int
+	next := 0.0
+	err = readPool(dir, "big.csv", s)(func(d ModelReq) error {
+		sizes = append(sizes, len(d.Data))
+		if len(d.input) != len(d.Data) {
+			t.Fatalf("chunk of %d rows kept %d as received", len(d.Data), len(d.input))
+		}
+		for _, row := range d.Data {
+			if row["x"] != next {
+				t.Fatalf("row %v, want x %v", row, next)
+			}
+			next++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{uncertainChunk, uncertainChunk, 5}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("chunks of %v rows, want %v", sizes, want)
+	}
+}
+
+func TestMostUncertainPoolErrors(t *testing.T) {
+	m := &Model{}
+	req := UncertainReq{Strategy: "least_confidence", N: 1}
+	for _, pool := range []Pool{
+		func(fn func(d ModelReq) error) error { return errors.New("mlserver: bad pool") },
+		uploadedPool(ModelReq{}),
+	} {
+		_, _, err := m.MostUncertain(pool, req)
+		if _, ok := err.(PoolError); !ok {
+			t.Errorf("error %#v, want a PoolError", err)
+		}
+	}
+}
+
+func TestByUncertainty(t *testing.T) {
+	rows := []UncertainRow{
+		{Row: 0, Score: 0.2},
+		{Row: 1, Score: 0.7},
+		{Row: 2, Score: 0.2},
+		{Row: 3, Score: 0.9},
+	}
+	sort.Sort(byUncertainty(rows))
+
+	var order []int
+	for _, row := range rows {
+		order = append(order, row.Row)
+	}
+	if want := []int{3, 1, 0, 2}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order %v, want %v", order, want)
+	}
+}
+
+func TestUncertaintyStrategies(t *testing.T) {
+	probs := map[string]float64{"a": 0.5, "b": 0.3, "c": 0.2}
+	tests := []struct {
+		strategy string
+		score    float64
+	}{
+		{"least_confidence", 0.5},
+		{"margin", 0.8},
+		{"entropy", 1.0297},
+	}
+
+	for _, tt := range tests {
+		score := uncertaintyStrategies[tt.strategy](probs)
+		if diff := score - tt.score; diff > 1e-4 || diff < -1e-4 {
+			t.Errorf("%s score %v, want %v", tt.strategy, score, tt.score)
+		}
+	}
+}
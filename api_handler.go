@@ -3,33 +3,77 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type server struct {
 	*ModelRepo
+	predictions *PredictionLog // nil unless predict requests are logged
 }
 
 // NewAPIHandler returns an http.Handler for responding to api requests to
 // mlserver. The ModelRepo parameter should be a pointer to an initialized
-// and indexed ModelRepo.
-func NewAPIHandler(r *ModelRepo) http.Handler {
-	s := &server{r}
+// and indexed ModelRepo. Sampled predict requests are written to the
+// PredictionLog, which may be nil.
+func NewAPIHandler(r *ModelRepo, l *PredictionLog) http.Handler {
+	s := &server{r, l}
 
 	m := http.NewServeMux()
 	m.HandleFunc("/models", s.HandleModels)
 	m.HandleFunc("/models/", s.HandleModel)
 	m.HandleFunc("/models/running", s.HandleRunningModels)
 	m.HandleFunc("/models/running/", s.HandleStopModel)
+	m.HandleFunc("/feedback", s.HandleFeedback)
 
 	return m
 }
 
 // HandleModel is the http handler for requests made to /models/<id>, GET
 // returns the model status, PUT/POST return predictions by the model. Other
-// HTTP methods result in a Method Not Allowed response.
+// HTTP methods result in a Method Not Allowed response. Requests for
+// /models/<id>/<resource> are passed to the handler for the resource.
 func (s *server) HandleModel(w http.ResponseWriter, r *http.Request) {
-	modelID := filepath.Base(r.URL.Path)
+	modelID, resource := splitModelPath(r.URL.Path)
+
+	switch resource {
+	case "":
+	case "leaderboard":
+		s.HandleLeaderboard(w, r, modelID)
+		return
+	case "evaluate":
+		s.HandleEvaluate(w, r, modelID)
+		return
+	case "evaluations":
+		s.HandleEvaluations(w, r, modelID)
+		return
+	case "features":
+		s.HandleFeatures(w, r, modelID)
+		return
+	case "dependence":
+		s.HandleDependence(w, r, modelID)
+		return
+	case "profile":
+		s.HandleProfile(w, r, modelID)
+		return
+	case "drift":
+		s.HandleDrift(w, r, modelID)
+		return
+	case "retrain":
+		s.HandleRetrain(w, r, modelID)
+		return
+	case "uncertain":
+		s.HandleUncertain(w, r, modelID)
+		return
+	case "batches":
+		s.HandleBatches(w, r, modelID)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 
 	switch r.Method {
 	case "GET": // status
@@ -47,6 +91,9 @@ func (s *server) HandleModel(w http.ResponseWriter, r *http.Request) {
 
 	case "PUT", "POST": // predict
 		var err error
+		start := time.Now()
+		reqID := requestID(r)
+		w.Header().Set("X-Request-ID", reqID)
 
 		m, err := s.Get(modelID)
 		if err == ErrModelNotFound {
@@ -58,14 +105,43 @@ func (s *server) HandleModel(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		newData, err := parseFitPredictRequest(r, false)
+		// keep the rows as received for feedback and the prediction log
+		sampled := s.predictions.Sampled(modelID)
+		schema := m.Schema
+		schema.keepInput = true
+		schema.drift, _ = m.driftMonitor()
+
+		newData, err := parsePredictRequest(r, schema)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			badRequest(w, err)
 			return
 		}
 		newData.ModelID = modelID
 
+		err = checkExplain(newData, m.Performance.Algorithm)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+
 		pred := m.Predict(newData)
+		schema.drift.observePredictions(pred.Labels)
+		err = m.savePredictions(&pred, newData.input, start.UTC())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sampled {
+			s.predictions.write(PredictionRecord{
+				RequestID:    reqID,
+				Time:         start.UTC(),
+				ModelID:      modelID,
+				ModelVersion: m.Metadata.Date.UTC().Format(time.RFC3339Nano),
+				Data:         newData.input,
+				Labels:       pred.Labels,
+				Latency:      float64(time.Since(start).Nanoseconds()) / 1e6,
+			})
+		}
 		writeJSONOK(w, pred)
 
 	default:
@@ -74,6 +150,450 @@ func (s *server) HandleModel(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// splitModelPath splits /models/<id>/<resource> into the model id and resource,
+// the resource is empty for /models/<id>
+func splitModelPath(path string) (string, string) {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(path, "/models/"), "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// HandleLeaderboard accepts GET requests made to /models/<id>/leaderboard and
+// responds with every candidate tried when fitting the model along with its
+// cross validation scores, best first. All other methods result in a Method Not
+// Allowed response.
+func (s *server) HandleLeaderboard(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "GET" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	candidates, err := m.Leaderboard()
+	if os.IsNotExist(err) {
+		http.Error(w, "leaderboard not available for model", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ModelID     string      `json:"model_id"`
+		Leaderboard []Candidate `json:"leaderboard"`
+	}{
+		m.ID,
+		candidates,
+	}
+	writeJSONOK(w, resp)
+}
+
+// HandleFeatures accepts GET requests made to /models/<id>/features and
+// responds with the global feature importances of the model, by feature and by
+// input column, see Model.Features. All other methods result in a Method Not
+// Allowed response.
+func (s *server) HandleFeatures(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "GET" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	imp, err := m.Features()
+	if os.IsNotExist(err) {
+		http.Error(w, "feature importances not available for model", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ModelID string `json:"model_id"`
+		Importances
+	}{
+		m.ID,
+		imp,
+	}
+	writeJSONOK(w, resp)
+}
+
+// HandleProfile accepts GET requests made to /models/<id>/profile and responds
+// with the profile of the model's training data, see DataProfile. All other
+// methods result in a Method Not Allowed response.
+func (s *server) HandleProfile(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "GET" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	p, err := m.Profile()
+	if os.IsNotExist(err) {
+		http.Error(w, "profile not available for model", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ModelID string `json:"model_id"`
+		DataProfile
+	}{
+		m.ID,
+		p,
+	}
+	writeJSONOK(w, resp)
+}
+
+// HandleDrift accepts GET requests made to /models/<id>/drift and responds with
+// the drift of recent predict requests from the training data, see Drift. All
+// other methods result in a Method Not Allowed response.
+func (s *server) HandleDrift(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "GET" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	d, err := m.Drift()
+	if os.IsNotExist(err) {
+		http.Error(w, "drift not available for model", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONOK(w, d)
+}
+
+// HandleDependence accepts POST requests made to /models/<id>/dependence with a
+// JSON encoded DependenceReq and responds with the partial dependence and ICE
+// curves of the column, see Model.Dependence. All other methods result in a
+// Method Not Allowed response.
+func (s *server) HandleDependence(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "POST" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.Get(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	req, err := ParseDependenceReq(r.Body)
+	if err == nil {
+		err = req.checkColumn(m.Schema)
+	}
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	d, err := m.Dependence(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONOK(w, d)
+}
+
+// HandleEvaluate accepts POST requests made to /models/<id>/evaluate with
+// labeled data in any of the formats accepted for fitting a model. The data is
+// predicted by the model and the predictions compared to the labels, the saved
+// evaluation is returned, see Model.Evaluate. All other methods result in a
+// Method Not Allowed response.
+func (s *server) HandleEvaluate(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "POST" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.Get(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	ds, err := parseEvaluateRequest(r, m.Schema)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	defer ds.Remove()
+
+	data, err := ds.Labeled()
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	data.ModelID = modelID
+
+	e, err := m.Evaluate(ds.Name, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, e, http.StatusCreated)
+}
+
+// HandleEvaluations accepts GET requests made to /models/<id>/evaluations and
+// responds with every saved evaluation of the model, oldest first. All other
+// methods result in a Method Not Allowed response.
+func (s *server) HandleEvaluations(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "GET" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	evals, err := m.Evaluations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ModelID     string       `json:"model_id"`
+		Evaluations []Evaluation `json:"evaluations"`
+	}{
+		m.ID,
+		evals,
+	}
+	writeJSONOK(w, resp)
+}
+
+// HandleRetrain accepts POST requests made to /models/<id>/retrain and fits a
+// new model from the training data snapshot of the model, the predictions that
+// received feedback, and any labeled data in the request body, in any of the
+// formats accepted for fitting a model, see Model.RetrainDataset. The id of the
+// new model is returned. All other methods result in a Method Not Allowed
+// response.
+func (s *server) HandleRetrain(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "POST" {
+		notAllowed(w)
+		return
+	}
+
+	parent, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	var extra *Dataset
+	if r.ContentLength != 0 || r.Header.Get("Content-Type") != "" {
+		extra, err = parseEvaluateRequest(r, parent.Schema)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		defer extra.Remove()
+	}
+
+	trainData, err := parent.RetrainDataset(extra)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	m := s.NewModel()
+	go fitModel(m, trainData, s.ModelRepo)
+
+	resp := struct {
+		ModelID  string `json:"model_id"`
+		ParentID string `json:"parent_id"`
+	}{
+		m.ID,
+		parent.ID,
+	}
+	writeJSON(w, resp, http.StatusAccepted)
+}
+
+// HandleUncertain accepts POST requests made to /models/<id>/uncertain with an
+// unlabeled pool, uploaded in any of the formats accepted for predictions or
+// stored and named by the pool query parameter, and responds with the rows the
+// model is least certain of, see ParseUncertainReq and Model.MostUncertain. All
+// other methods result in a Method Not Allowed response.
+func (s *server) HandleUncertain(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "POST" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.Get(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	req, err := ParseUncertainReq(r.URL.Query())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	var pool Pool
+	if req.Pool != "" {
+		pool = readPool(*poolDir, req.Pool, m.Schema)
+	} else {
+		schema := m.Schema
+		schema.keepInput = true
+		d, err := parsePredictRequest(r, schema)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		pool = uploadedPool(d)
+	}
+
+	b, rows, err := m.MostUncertain(pool, req)
+	if perr, ok := err.(PoolError); ok {
+		badRequest(w, perr.Err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Batch
+		Rows []UncertainRow `json:"rows"`
+	}{
+		b,
+		rows,
+	}
+	writeJSON(w, resp, http.StatusCreated)
+}
+
+// HandleBatches accepts GET requests made to /models/<id>/batches and responds
+// with the batches of rows selected for labeling, see Model.Batches. All other
+// methods result in a Method Not Allowed response.
+func (s *server) HandleBatches(w http.ResponseWriter, r *http.Request, modelID string) {
+	if r.Method != "GET" {
+		notAllowed(w)
+		return
+	}
+
+	m, err := s.LoadModelData(modelID)
+	if err != nil {
+		modelError(w, err)
+		return
+	}
+
+	batches, err := m.Batches()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ModelID string  `json:"model_id"`
+		Batches []Batch `json:"batches"`
+	}{
+		m.ID,
+		batches,
+	}
+	writeJSONOK(w, resp)
+}
+
+// HandleFeedback accepts POST requests made to /feedback with the true labels
+// of earlier predictions, see ParseFeedback. Each label is joined to its
+// prediction and the live metrics of the model updated, see Model.AddFeedback.
+// The response lists the prediction ids that weren't found. All other methods
+// result in a Method Not Allowed response.
+func (s *server) HandleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notAllowed(w)
+		return
+	}
+
+	feedback, err := ParseFeedback(r.Body)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	// feedback is grouped by model, keeping the order models first appear in
+	var modelIDs []string
+	byModel := make(map[string][]Feedback)
+	for _, fb := range feedback {
+		id := predictionModelID(fb.PredictionID)
+		if _, ok := byModel[id]; !ok {
+			modelIDs = append(modelIDs, id)
+		}
+		byModel[id] = append(byModel[id], fb)
+	}
+
+	resp := struct {
+		Accepted int      `json:"accepted"`
+		Unknown  []string `json:"unknown"`
+	}{
+		Unknown: []string{},
+	}
+	for _, id := range modelIDs {
+		var m *Model
+		err := ErrModelNotFound
+		if id != "" {
+			m, err = s.LoadModelData(id)
+		}
+		if err == ErrModelNotFound {
+			for _, fb := range byModel[id] {
+				resp.Unknown = append(resp.Unknown, fb.PredictionID)
+			}
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		unknown, err := m.AddFeedback(byModel[id])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Accepted += len(byModel[id]) - len(unknown)
+		resp.Unknown = append(resp.Unknown, unknown...)
+	}
+	writeJSONOK(w, resp)
+}
+
 // HandleModels is the http handler for requests made to /models, POST
 // fits a new model with the supplied data. Data for fitting the model can
 // be encoded as JSON in the request body or uploaded as a csv file. GET responds
@@ -86,9 +606,9 @@ func (s *server) HandleModels(w http.ResponseWriter, r *http.Request) {
 
 	case "POST": // new model
 
-		trainData, err := parseFitPredictRequest(r, true)
+		trainData, err := parseFitRequest(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			badRequest(w, err)
 			return
 		}
 
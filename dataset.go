@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// ErrLabelCount is returned when the number of labels supplied with a JSON fit
+// request does not match the number of rows
+var ErrLabelCount = errors.New("mlserver: number of labels does not match number of rows")
+
+// Dataset is the training data supplied with a fit request. The data is
+// spooled to a temporary file as it is received and read back one row at a
+// time, memory use does not depend on the size of the dataset. Profile reads
+// the spooled rows once to validate the data and gather the per column
+// statistics used to resolve the schema, WriteCSV reads them again to write the
+// transformed data for fit.py.
+type Dataset struct {
+	Name   string
+	Schema Schema
+	Search Search // model selection options from the fit request
+	Rows   int
+
+	// Snapshot keeps a copy of the data with the model so it can be
+	// retrained, see FitConfig
+	Snapshot bool
+
+	// the schema as requested, before it is resolved against the data, and
+	// the model retrained to fit the dataset, if any
+	requested Schema
+	lineage   *Lineage
+
+	format       string   // formatCSV for delimited text, formatNDJSON, or formatSVMLight
+	path         string   // spooled delimited text, JSON rows, or svmlight data
+	labelPath    string   // spooled JSON labels, when supplied separately from the rows
+	header       []string // csv header
+	columns      []string // all columns present in the data, sorted
+	stats        map[string]*columnStats
+	labels       *columnStats    // stats for labels supplied separately or in svmlight data
+	indicators   map[string]bool // multi-hot columns from flattened JSON arrays
+	isRegression bool
+}
+
+// SpoolCSV copies delimited text data to a temporary file, the data is parsed
+// according to the dialect in the schema of the returned Dataset
+func SpoolCSV(r io.Reader) (*Dataset, error) {
+	path, err := spool(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Dataset{format: formatCSV, path: path}, nil
+}
+
+// SpoolNDJSON copies newline delimited JSON data to a temporary file, each line
+// should be a JSON object representing a single row. The labels are read from
+// the target column named in the schema of the returned Dataset.
+func SpoolNDJSON(r io.Reader) (*Dataset, error) {
+	path, err := spool(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Dataset{format: formatNDJSON, path: path}, nil
+}
+
+// SpoolJSON reads a JSON encoded fit request:
+//
+//		{
+//			"name": "iris model",
+//			"data": [
+//				{
+//					"var_1": 2.5,
+//					"var_2": 3.6,
+//					...
+//				},
+//				...
+//			],
+//			"labels": [
+//				"yes",
+//				"no",
+//				...
+//			]
+//		}
+//
+// The elements of the data and labels arrays are decoded one at a time and
+// copied to temporary files, the remaining fields are decoded into the name and
+// schema of the returned Dataset.
+func SpoolJSON(r io.Reader) (*Dataset, error) {
+	ds := &Dataset{format: formatNDJSON}
+
+	dec := json.NewDecoder(r)
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			ds.Remove()
+			return nil, err
+		}
+		key, _ := tok.(string)
+
+		switch key {
+		case "data":
+			ds.path, err = spoolJSONArray(dec)
+		case "labels":
+			ds.labelPath, err = spoolJSONArray(dec)
+		default:
+			var val json.RawMessage
+			err = dec.Decode(&val)
+			fields[key] = val
+		}
+		if err != nil {
+			ds.Remove()
+			return nil, err
+		}
+	}
+
+	if ds.path == "" {
+		ds.Remove()
+		return nil, errors.New("mlserver: data missing")
+	}
+
+	// decode the remaining fields as if they were the whole request
+	b, err := json.Marshal(fields)
+	if err == nil {
+		var req struct {
+			Name     string `json:"name"`
+			Search   Search `json:"search"`
+			Scoring  string `json:"scoring"`
+			Snapshot bool   `json:"snapshot"`
+			Schema
+		}
+		err = json.Unmarshal(b, &req)
+		ds.Name, ds.Schema, ds.Search, ds.Snapshot = req.Name, req.Schema, req.Search, req.Snapshot
+		if req.Scoring != "" {
+			ds.Search.Scoring = req.Scoring
+		}
+	}
+	if err != nil {
+		ds.Remove()
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// spoolJSONArray copies each element of the array at the current position of
+// dec to a temporary file, one element per line
+func spoolJSONArray(dec *json.Decoder) (string, error) {
+	err := expectDelim(dec, '[')
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "mlserver-spool")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+
+	for dec.More() {
+		var val json.RawMessage
+		err = dec.Decode(&val)
+		if err == nil {
+			_, err = w.Write(append(val, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	err = expectDelim(dec, ']')
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return errors.New("mlserver: expected " + delim.String() + " in JSON request")
+	}
+	return nil
+}
+
+// spool copies r to a temporary file, returning the file name
+func spool(r io.Reader) (string, error) {
+	f, err := ioutil.TempFile("", "mlserver-spool")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Remove deletes the spooled data
+func (ds *Dataset) Remove() {
+	for _, path := range []string{ds.path, ds.labelPath} {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+}
+
+// Profile reads the spooled data in a single pass, checking that every row is
+// well formed and gathering statistics for each column. The schema is then
+// resolved against the statistics, see Schema.Fit. For csv data, the target
+// defaults to the first column and the column names of files without a header
+// are saved in the dialect. Only the labels are profiled for svmlight data,
+// keeping statistics for every feature of high dimensional data would use more
+// memory than the data itself.
+func (ds *Dataset) Profile() error {
+	if len(ds.Schema.NA) == 0 {
+		ds.Schema.NA = defaultNA
+	}
+	ds.Schema.Sparse = ds.format == formatSVMLight
+
+	err := ds.Schema.validatePreprocess()
+	if err != nil {
+		return err
+	}
+
+	ds.Rows = 0
+	ds.columns = nil
+	ds.stats = make(map[string]*columnStats)
+	ds.indicators = make(map[string]bool)
+	ds.labels = nil
+	if ds.labelPath != "" || ds.format == formatSVMLight {
+		ds.labels = newColumnStats()
+	}
+
+	err = ds.each(func(row map[string]interface{}, label interface{}) error {
+		for col, raw := range row {
+			if ds.Schema.Sparse {
+				break
+			}
+			c, ok := ds.stats[col]
+			if !ok {
+				c = newColumnStats()
+				ds.stats[col] = c
+				ds.columns = append(ds.columns, col)
+			}
+			c.add(ds.Schema, col, raw)
+		}
+		if ds.labels != nil {
+			ds.labels.add(ds.Schema, ds.Schema.Target, label)
+		}
+		ds.Rows++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(ds.columns)
+
+	if ds.format == formatCSV && ds.Schema.Target == "" && len(ds.header) > 0 {
+		ds.Schema.Target = ds.header[0]
+	}
+	if ds.format == formatCSV && ds.Schema.Dialect.NoHeader {
+		ds.Schema.Dialect.Columns = ds.header
+	}
+
+	err = ds.Schema.Fit(ds)
+	if err != nil {
+		return err
+	}
+
+	ds.isRegression = ds.labelStats().isNumeric()
+	return nil
+}
+
+// labelStats returns the statistics for the labels, either supplied separately
+// or in the target column, nil is returned if there are no labels
+func (ds *Dataset) labelStats() *columnStats {
+	if ds.labels != nil {
+		return ds.labels
+	}
+	return ds.stats[ds.Schema.Target]
+}
+
+// WriteCSV writes the training data transformed according to the schema as
+// csv. The first column holds the labels, the remaining columns hold the
+// features sorted by name. Missing values are written as empty cells.
+func (ds *Dataset) WriteCSV(w io.Writer) error {
+	s := ds.Schema
+	features := s.features()
+
+	cw := csv.NewWriter(w)
+	record := make([]string, len(features)+1)
+
+	record[0] = "label"
+	copy(record[1:], features)
+	err := cw.Write(record)
+	if err != nil {
+		return err
+	}
+
+	err = ds.each(func(row map[string]interface{}, label interface{}) error {
+		if s.Target != "" {
+			label = row[s.Target]
+		}
+		if ds.isRegression {
+			label, _ = s.parseCell(label)
+		}
+		record[0] = categoricalValue(label)
+
+		s.applyRow(row)
+		for i, col := range features {
+			val, ok := row[col]
+			if !ok {
+				record[i+1] = ""
+				continue
+			}
+			record[i+1] = categoricalValue(val)
+		}
+		return cw.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ErrNoLabeledRows is returned when labeled data has no rows
+var ErrNoLabeledRows = errors.New("mlserver: no labeled rows")
+
+// Labeled reads the spooled data of a dataset with a schema saved with a model,
+// returning the rows transformed the same way as predict requests along with
+// the labels, taken from the target column or supplied separately. Every row
+// needs a label.
+func (ds *Dataset) Labeled() (ModelReq, error) {
+	s := ds.Schema
+	var d ModelReq
+
+	err := ds.each(func(row map[string]interface{}, label interface{}) error {
+		if label == nil && s.Target != "" {
+			label = row[s.Target]
+		}
+		if _, ok := s.parseCell(label); !ok {
+			return fmt.Errorf("mlserver: row %d is missing a label", len(d.Data)+1)
+		}
+
+		s.applyRow(row)
+		d.Data = append(d.Data, row)
+		d.Labels = append(d.Labels, label)
+		return nil
+	})
+	if err != nil {
+		return ModelReq{}, err
+	}
+	if len(d.Data) == 0 {
+		return ModelReq{}, ErrNoLabeledRows
+	}
+
+	return d, nil
+}
+
+// each reads the spooled data calling fn for every row, label is nil unless
+// the labels were supplied separately from the rows or the data is svmlight.
+// Nested JSON values are flattened and the preprocessing steps of the schema
+// are applied before fn is called.
+func (ds *Dataset) each(fn func(row map[string]interface{}, label interface{}) error) error {
+	return ds.eachRaw(func(row map[string]interface{}, label interface{}) error {
+		if ds.format == formatNDJSON {
+			ds.Schema.Flatten.apply(row, ds.indicators)
+		}
+		ds.Schema.preprocess(row)
+		return fn(row, label)
+	})
+}
+
+// eachRaw reads the spooled data calling fn for every row as it was received,
+// see each
+func (ds *Dataset) eachRaw(fn func(row map[string]interface{}, label interface{}) error) error {
+	f, err := os.Open(ds.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if ds.format == formatCSV {
+		return ds.eachCSV(bufio.NewReader(f), fn)
+	}
+	if ds.format == formatSVMLight {
+		return ds.eachSVMLight(f, fn)
+	}
+
+	rows := json.NewDecoder(bufio.NewReader(f))
+	var labels *json.Decoder
+	if ds.labelPath != "" {
+		lf, err := os.Open(ds.labelPath)
+		if err != nil {
+			return err
+		}
+		defer lf.Close()
+		labels = json.NewDecoder(bufio.NewReader(lf))
+	}
+
+	for {
+		var row map[string]interface{}
+		err := rows.Decode(&row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return errors.New("mlserver: data rows must be JSON objects")
+		}
+
+		var label interface{}
+		if labels != nil {
+			err = labels.Decode(&label)
+			if err == io.EOF {
+				return ErrLabelCount
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err = fn(row, label)
+		if err != nil {
+			return err
+		}
+	}
+
+	if labels != nil {
+		var label interface{}
+		if labels.Decode(&label) != io.EOF {
+			return ErrLabelCount
+		}
+	}
+	return nil
+}
+
+func (ds *Dataset) eachCSV(r io.Reader, fn func(row map[string]interface{}, label interface{}) error) error {
+	reader, err := ds.Schema.Dialect.newReader(r, ds.Schema.Target)
+	if err != nil {
+		return err
+	}
+	fieldNames := reader.Header
+	ds.header = fieldNames
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(record) != len(fieldNames) {
+			return errors.New("mlserver: csv header and row length mismatch")
+		}
+
+		row := make(map[string]interface{}, len(record))
+		for i, val := range record {
+			row[fieldNames[i]] = val
+		}
+
+		err = fn(row, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// timeLayouts lists the accepted timestamp formats, values without a time zone
+// are UTC
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// dateParts names the numeric features derived from a datetime column, the
+// feature names are the column name followed by _ and the part
+var dateParts = []string{"year", "month", "dayofweek", "hour", "epoch"}
+
+// parseTime parses an ISO 8601 date or timestamp, the second return value is
+// false when raw is not a string in one of timeLayouts
+func parseTime(raw interface{}) (time.Time, bool) {
+	val, ok := raw.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	val = strings.TrimSpace(val)
+	if len(val) < 10 || val[4] != '-' {
+		return time.Time{}, false
+	}
+
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, val)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// expandTime replaces the datetime column col of row with the derived numeric
+// features. The year, month (1-12), day of week (0 is Sunday), and hour are in
+// the time zone of the timestamp, epoch is seconds since 1970-01-01 UTC.
+func expandTime(row map[string]interface{}, col string) {
+	raw, ok := row[col]
+	if !ok {
+		return
+	}
+	delete(row, col)
+
+	t, ok := parseTime(raw)
+	if !ok {
+		return
+	}
+	row[col+"_year"] = float64(t.Year())
+	row[col+"_month"] = float64(t.Month())
+	row[col+"_dayofweek"] = float64(t.Weekday())
+	row[col+"_hour"] = float64(t.Hour())
+	row[col+"_epoch"] = float64(t.UnixNano()) / 1e9
+}
+
+// featureTypes returns the type of each feature passed to fit.py, datetime
+// columns are replaced by their numeric derived features
+func (s Schema) featureTypes() map[string]string {
+	types := make(map[string]string, len(s.Types))
+	for col, typ := range s.Types {
+		if typ != typeDatetime {
+			types[col] = typ
+			continue
+		}
+		for _, part := range dateParts {
+			types[col+"_"+part] = typeNumeric
+		}
+	}
+	return types
+}
+
+// sourceColumn returns the column a feature passed to fit.py was derived from,
+// the datetime column for its derived features, otherwise the feature itself
+func (s Schema) sourceColumn(feature string) string {
+	for _, part := range dateParts {
+		col := strings.TrimSuffix(feature, "_"+part)
+		if col != feature && s.Types[col] == typeDatetime {
+			return col
+		}
+	}
+	return feature
+}
+
+// features returns the names of the features passed to fit.py, sorted
+func (s Schema) features() []string {
+	types := s.featureTypes()
+	names := make([]string, 0, len(types))
+	for col := range types {
+		names = append(names, col)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		raw  interface{}
+		want time.Time
+		ok   bool
+	}{
+		{"2014-03-02", time.Date(2014, 3, 2, 0, 0, 0, 0, time.UTC), true},
+		{" 2014-03-02 10:30 ", time.Date(2014, 3, 2, 10, 30, 0, 0, time.UTC), true},
+		{"2014-03-02T10:30:05", time.Date(2014, 3, 2, 10, 30, 5, 0, time.UTC), true},
+		{"2014-03-02 10:30:05", time.Date(2014, 3, 2, 10, 30, 5, 0, time.UTC), true},
+		{"2014-03-02T10:30:05.25Z", time.Date(2014, 3, 2, 10, 30, 5, 250000000, time.UTC), true},
+		{"2014-03-02 10:30:05-05:00", time.Date(2014, 3, 2, 15, 30, 5, 0, time.UTC), true},
+		{"2014-13-02", time.Time{}, false},
+		{"03/02/2014", time.Time{}, false},
+		{"20140302", time.Time{}, false},
+		{"2014", time.Time{}, false},
+		{20140302.0, time.Time{}, false},
+		{nil, time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseTime(tt.raw)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseTime(%#v) = %v, %v, want %v, %v", tt.raw, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExpandTime(t *testing.T) {
+	row := map[string]interface{}{"day": "2014-03-02T10:30:00+02:00", "bad": "soon", "x": 1.0}
+	expandTime(row, "day")
+	expandTime(row, "bad")
+	expandTime(row, "missing")
+
+	want := map[string]interface{}{
+		"day_year":      2014.0,
+		"day_month":     3.0,
+		"day_dayofweek": 0.0, // a Sunday
+		"day_hour":      10.0,
+		"day_epoch":     float64(time.Date(2014, 3, 2, 8, 30, 0, 0, time.UTC).Unix()),
+		"x":             1.0,
+	}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("expanded %v, want %v", row, want)
+	}
+}
+
+func TestDatetimeFeatures(t *testing.T) {
+	s := Schema{Types: map[string]string{"day": typeDatetime, "day_count": typeNumeric, "c": typeCategorical}}
+
+	want := []string{"c", "day_count", "day_dayofweek", "day_epoch", "day_hour", "day_month", "day_year"}
+	if got := s.features(); !reflect.DeepEqual(got, want) {
+		t.Errorf("features %v, want %v", got, want)
+	}
+	if typ := s.featureTypes()["day_hour"]; typ != typeNumeric {
+		t.Errorf("day_hour is %s, want numeric", typ)
+	}
+
+	for feature, col := range map[string]string{"day_epoch": "day", "day_count": "day_count", "c": "c", "c_year": "c_year"} {
+		if got := s.sourceColumn(feature); got != col {
+			t.Errorf("sourceColumn(%q) = %q, want %q", feature, got, col)
+		}
+	}
+}
+
+func TestImputeDatetime(t *testing.T) {
+	// the most frequent timestamp whatever the strategy
+	ds := profileCSV(t, "label,day\na,2014-03-02\nb,2014-03-02\na,\nb,2014-03-05\n", Schema{Target: "label", Impute: "mean"})
+	defer ds.Remove()
+	if fill := ds.Schema.Fill["day"]; fill != "2014-03-02" {
+		t.Errorf("fill %v, want 2014-03-02", fill)
+	}
+	rows := predictCSV(t, "day,x\n,1\n", ds.Schema)
+	if rows[0]["day_month"] != 3.0 || rows[0]["day_year"] != 2014.0 {
+		t.Errorf("filled row %v, want the expanded fill value", rows[0])
+	}
+
+	// the median timestamp when none is frequent enough to be tracked
+	var buf bytes.Buffer
+	buf.WriteString("label,day\n")
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= frequentCapacity; i++ {
+		fmt.Fprintf(&buf, "a,%s\n", start.AddDate(0, 0, i).Format("2006-01-02"))
+	}
+	buf.WriteString("b,\n")
+	spread := profileCSV(t, buf.String(), Schema{Target: "label", Impute: "median"})
+	defer spread.Remove()
+
+	fill, _ := spread.Schema.Fill["day"].(string)
+	median, ok := parseTime(fill)
+	want := start.AddDate(0, 0, frequentCapacity/2)
+	if !ok || median.Sub(want) > 48*time.Hour || want.Sub(median) > 48*time.Hour {
+		t.Errorf("fill %v, want about %v", spread.Schema.Fill["day"], want)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// limits on partial dependence requests, every row is predicted at every value
+// of the grid in a single batch
+const (
+	defaultGridPoints = 10
+	maxGridPoints     = 100
+	maxDependenceRows = 50000 // rows times grid values
+)
+
+// DependenceReq asks how the predictions of a model change as one input column
+// varies, for example:
+//
+//		{
+//			"column": "petal_length",
+//			"min": 1, "max": 7, "points": 13,
+//			"data": [{"sepal_length": 6.7, "sepal_width": 3.0, "petal_width": 2.3}]
+//		}
+//
+// The column is set to each value of the grid in every row of data, a single
+// base row or a sample of rows. The grid is either a list of values, which may
+// be categories, or points evenly spaced numbers from min to max.
+type DependenceReq struct {
+	Column string                   `json:"column"`
+	Values []interface{}            `json:"values"`
+	Min    *float64                 `json:"min"`
+	Max    *float64                 `json:"max"`
+	Points int                      `json:"points"`
+	Data   []map[string]interface{} `json:"data"`
+}
+
+// Dependence holds the predictions of a model across the grid of values for a
+// column: Average is the partial dependence, the mean predicted probability of
+// each class at each value, Rows holds the individual conditional expectation
+// (ICE) curve of each row, its predicted probabilities at each value.
+type Dependence struct {
+	ModelID string                 `json:"model_id"`
+	Column  string                 `json:"column"`
+	Values  []interface{}          `json:"values"`
+	Average []map[string]float64   `json:"average"`
+	Rows    [][]map[string]float64 `json:"rows"`
+}
+
+// ParseDependenceReq decodes a JSON encoded partial dependence request and
+// checks it, the grid is filled in from min, max, and points when no values are
+// listed
+func ParseDependenceReq(r io.Reader) (DependenceReq, error) {
+	var req DependenceReq
+	err := json.NewDecoder(r).Decode(&req)
+	if err != nil {
+		return DependenceReq{}, err
+	}
+
+	if req.Column == "" {
+		return DependenceReq{}, errors.New("mlserver: column is required")
+	}
+	if len(req.Data) == 0 {
+		return DependenceReq{}, errors.New("mlserver: data should hold at least one row")
+	}
+
+	if len(req.Values) == 0 {
+		if req.Min == nil || req.Max == nil {
+			return DependenceReq{}, errors.New("mlserver: values or min and max are required")
+		}
+		if *req.Min >= *req.Max {
+			return DependenceReq{}, errors.New("mlserver: min should be less than max")
+		}
+		if req.Points == 0 {
+			req.Points = defaultGridPoints
+		}
+		if req.Points < 2 || req.Points > maxGridPoints {
+			return DependenceReq{}, fmt.Errorf("mlserver: points should be between 2 and %d", maxGridPoints)
+		}
+		step := (*req.Max - *req.Min) / float64(req.Points-1)
+		for i := 0; i < req.Points; i++ {
+			req.Values = append(req.Values, *req.Min+float64(i)*step)
+		}
+	}
+	if len(req.Values) > maxGridPoints {
+		return DependenceReq{}, fmt.Errorf("mlserver: the grid should have at most %d values", maxGridPoints)
+	}
+	if len(req.Values)*len(req.Data) > maxDependenceRows {
+		return DependenceReq{}, fmt.Errorf("mlserver: rows times grid values should be at most %d", maxDependenceRows)
+	}
+
+	return req, nil
+}
+
+// checkColumn returns an error when the column of the request isn't a feature
+// of a model fit with schema s. The column is a feature when it has a type or is
+// read by one of the preprocessing steps, every column is allowed for sparse
+// models, which keep no types.
+func (req DependenceReq) checkColumn(s Schema) error {
+	if s.Sparse || len(s.Types) == 0 {
+		return nil
+	}
+	if _, ok := s.Types[req.Column]; ok {
+		return nil
+	}
+	for _, t := range s.Preprocess {
+		if t.Column == req.Column {
+			return nil
+		}
+	}
+	return fmt.Errorf("mlserver: column %q is not a feature of the model", req.Column)
+}
+
+// Dependence predicts every row of the request with the column set to each
+// value of the grid. Nested values are flattened before the column is set, so
+// the column may name a flattened column, the rows are then transformed by the
+// schema the same way as predict requests. All of the rows are sent to the
+// running model in a single batch.
+func (m *Model) Dependence(req DependenceReq) (Dependence, error) {
+	s := m.Schema
+	var batch ModelReq
+	batch.ModelID = m.ID
+	for _, row := range req.Data {
+		s.Flatten.apply(row, nil)
+		for _, val := range req.Values {
+			grid := make(map[string]interface{}, len(row)+1)
+			for col, raw := range row {
+				grid[col] = raw
+			}
+			grid[req.Column] = val
+			s.preprocess(grid)
+			s.applyRow(grid)
+			batch.Data = append(batch.Data, grid)
+		}
+	}
+
+	pred := m.Predict(batch)
+	if len(pred.Labels) != len(batch.Data) {
+		return Dependence{}, fmt.Errorf("mlserver: model returned %d predictions for %d rows", len(pred.Labels), len(batch.Data))
+	}
+
+	d := Dependence{
+		ModelID: m.ID,
+		Column:  req.Column,
+		Values:  req.Values,
+		Average: make([]map[string]float64, len(req.Values)),
+		Rows:    make([][]map[string]float64, len(req.Data)),
+	}
+	for j := range req.Values {
+		d.Average[j] = make(map[string]float64)
+	}
+	n := float64(len(req.Data))
+	for i := range req.Data {
+		d.Rows[i] = pred.Labels[i*len(req.Values) : (i+1)*len(req.Values)]
+		for j, probs := range d.Rows[i] {
+			for class, p := range probs {
+				d.Average[j][class] += p / n
+			}
+		}
+	}
+
+	return d, nil
+}
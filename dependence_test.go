@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDependenceReq(t *testing.T) {
+	tests := []struct {
+		body   string
+		values []interface{}
+		err    string // empty when the request is valid
+	}{
+		{`{"column": "x", "values": ["a", "b"], "data": [{}]}`, []interface{}{"a", "b"}, ""},
+		{`{"column": "x", "min": 0, "max": 1, "points": 3, "data": [{}]}`, []interface{}{0.0, 0.5, 1.0}, ""},
+		{`{"column": "x", "min": 0, "max": 9, "data": [{}]}`, nil, ""},
+		{`{"values": [1], "data": [{}]}`, nil, "column is required"},
+		{`{"column": "x", "values": [1]}`, nil, "at least one row"},
+		{`{"column": "x", "min": 0, "data": [{}]}`, nil, "values or min and max are required"},
+		{`{"column": "x", "min": 1, "max": 1, "data": [{}]}`, nil, "min should be less than max"},
+		{`{"column": "x", "min": 0, "max": 1, "points": 1, "data": [{}]}`, nil, "points should be between 2 and 100"},
+		{`{"column": "x", "min": 0, "max": 1, "points": 101, "data": [{}]}`, nil, "points should be between 2 and 100"},
+		{`{"column": "x"`, nil, "EOF"},
+	}
+
+	for _, tt := range tests {
+		req, err := ParseDependenceReq(strings.NewReader(tt.body))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.body, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.body, err)
+			continue
+		}
+		if tt.values != nil && len(req.Values) != len(tt.values) {
+			t.Errorf("%s: grid %v, want %v", tt.body, req.Values, tt.values)
+			continue
+		}
+		for i, val := range tt.values {
+			if req.Values[i] != val {
+				t.Errorf("%s: grid %v, want %v", tt.body, req.Values, tt.values)
+				break
+			}
+		}
+		if tt.values == nil && len(req.Values) != defaultGridPoints {
+			t.Errorf("%s: %d grid values, want %d", tt.body, len(req.Values), defaultGridPoints)
+		}
+	}
+}
+
+func TestParseDependenceReqTooManyRows(t *testing.T) {
+	body := `{"column": "x", "min": 0, "max": 1, "points": 100, "data": [` +
+		strings.Repeat(`{},`, 500) + `{}]}`
+	_, err := ParseDependenceReq(strings.NewReader(body))
+	if err == nil || !strings.Contains(err.Error(), "at most 50000") {
+		t.Errorf("error %v, want the row limit", err)
+	}
+}
+
+func TestDependenceCheckColumn(t *testing.T) {
+	s := Schema{
+		Target:     "label",
+		Ignore:     []string{"id"},
+		Types:      map[string]string{"age": typeNumeric, "user.city": typeCategorical, "income_log": typeNumeric},
+		Preprocess: []Transform{{Op: opRename, Column: "income", To: "income_log"}},
+	}
+	tests := []struct {
+		column string
+		ok     bool
+	}{
+		{"age", true},
+		{"user.city", true},
+		{"income", true},
+		{"label", false},
+		{"id", false},
+		{"agee", false},
+	}
+
+	for _, tt := range tests {
+		err := DependenceReq{Column: tt.column}.checkColumn(s)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkColumn(%q) = %v, want ok %v", tt.column, err, tt.ok)
+		}
+	}
+
+	if err := (DependenceReq{Column: "f12"}).checkColumn(Schema{Sparse: true}); err != nil {
+		t.Errorf("sparse model: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Dialect describes the format of delimited text data, the zero value is
+// comma separated with a header row. The dialect used for the training data is
+// saved with the model and is the default for csv files uploaded with predict
+// requests.
+type Dialect struct {
+	// Delimiter separates fields, defaults to ","
+	Delimiter string `json:"delimiter,omitempty"`
+	// Quote encloses fields holding the delimiter or line breaks, defaults
+	// to `"`. Quotes inside a quoted field are escaped by doubling them.
+	Quote string `json:"quote,omitempty"`
+	// Comment starts lines that should be skipped, disabled when empty
+	Comment string `json:"comment,omitempty"`
+	// NoHeader is true when the first row holds data rather than column names
+	NoHeader bool `json:"no_header,omitempty"`
+	// Columns names the columns of files without a header, defaults to
+	// column_1, column_2, ... After fitting, this holds the names used for the
+	// training data.
+	Columns []string `json:"columns,omitempty"`
+}
+
+// validate returns a description of each problem with the dialect
+func (d Dialect) validate() []string {
+	var errs []string
+	for _, opt := range []struct{ name, val string }{
+		{"delimiter", d.Delimiter},
+		{"quote", d.Quote},
+		{"comment", d.Comment},
+	} {
+		if opt.val == "" {
+			continue
+		}
+		if utf8.RuneCountInString(opt.val) != 1 || opt.val == "\r" || opt.val == "\n" {
+			errs = append(errs, fmt.Sprintf("%s %q should be a single character", opt.name, opt.val))
+		}
+	}
+
+	if len(d.Quote) > 1 {
+		errs = append(errs, fmt.Sprintf("quote %q should be an ascii character", d.Quote))
+	}
+	if d.Quote != "" && (d.Quote == d.Delimiter || d.Quote == d.Comment) {
+		errs = append(errs, "quote can't be the same as the delimiter or comment character")
+	}
+	if d.Quote != "" && d.Quote != `"` && (d.Delimiter == `"` || d.Comment == `"`) {
+		errs = append(errs, `delimiter and comment can't be " when using a different quote`)
+	}
+	if d.Delimiter != "" && d.Delimiter == d.Comment {
+		errs = append(errs, "delimiter can't be the same as the comment character")
+	}
+
+	return errs
+}
+
+// readDialect overrides the fields of d with the dialect options present in a
+// multipart form or query string: delimiter, quote, comment, header, and
+// columns. The tsv format sets a tab delimiter, csv keeps the delimiter of d.
+// \t or tab can be used for a tab delimiter, header is true/present or
+// false/absent.
+func readDialect(d Dialect, format string, form map[string][]string) (Dialect, error) {
+	switch format {
+	case "", formatCSV:
+	case formatTSV:
+		d.Delimiter = "\t"
+	case formatNDJSON, formatSVMLight:
+		return d, nil
+	default:
+		return d, SchemaError{fmt.Sprintf("unknown format %q", format)}
+	}
+
+	if _, ok := form["delimiter"]; ok {
+		d.Delimiter = strings.Join(form["delimiter"], "")
+		if d.Delimiter == `\t` || d.Delimiter == "tab" {
+			d.Delimiter = "\t"
+		}
+	}
+	if _, ok := form["quote"]; ok {
+		d.Quote = strings.Join(form["quote"], "")
+	}
+	if _, ok := form["comment"]; ok {
+		d.Comment = strings.Join(form["comment"], "")
+	}
+
+	var errs SchemaError
+	if header := strings.ToLower(formValue(form, "header")); header != "" {
+		switch header {
+		case "present":
+			d.NoHeader = false
+		case "absent":
+			d.NoHeader = true
+		default:
+			present, err := strconv.ParseBool(header)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("header %q should be true or false", header))
+			}
+			d.NoHeader = !present
+		}
+	}
+	if columns := splitFormList(form["columns"]); len(columns) > 0 {
+		d.Columns = columns
+	}
+
+	errs = append(errs, d.validate()...)
+	if len(errs) > 0 {
+		return d, errs
+	}
+	return d, nil
+}
+
+// names returns the column names for a file without a header with n columns.
+// When d.Columns is set, the file should have the same columns, optionally
+// without the target column.
+func (d Dialect) names(n int, target string) ([]string, error) {
+	if len(d.Columns) == 0 {
+		names := make([]string, n)
+		for i := range names {
+			names[i] = "column_" + strconv.Itoa(i+1)
+		}
+		return names, nil
+	}
+
+	if n == len(d.Columns) {
+		return d.Columns, nil
+	}
+	if n == len(d.Columns)-1 && contains(d.Columns, target) {
+		names := make([]string, 0, n)
+		for _, col := range d.Columns {
+			if col != target {
+				names = append(names, col)
+			}
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("mlserver: expected %d columns, found %d", len(d.Columns), n)
+}
+
+// recordReader reads records from delimited text data according to a Dialect
+type recordReader struct {
+	cr     *csv.Reader
+	quote  byte     // quote character swapped with '"', 0 when the quote is '"'
+	first  []string // first record of a file without a header
+	Header []string
+}
+
+// newReader returns a recordReader for r, the header is read immediately. For
+// files without a header, the columns are named by d.names.
+func (d Dialect) newReader(r io.Reader, target string) (*recordReader, error) {
+	rr := &recordReader{}
+
+	// encoding/csv only supports '"' for quoting, swapping the quote character
+	// with '"' in the input and back in each field has the same effect
+	if d.Quote != "" && d.Quote != `"` {
+		rr.quote = d.Quote[0]
+		r = &swapReader{r, rr.quote, '"'}
+	}
+
+	rr.cr = csv.NewReader(r)
+	if d.Delimiter != "" {
+		rr.cr.Comma, _ = utf8.DecodeRuneInString(d.Delimiter)
+	}
+	if d.Comment != "" {
+		rr.cr.Comment, _ = utf8.DecodeRuneInString(d.Comment)
+	}
+
+	record, err := rr.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.NoHeader {
+		rr.Header = record
+		return rr, nil
+	}
+
+	rr.first = record
+	rr.Header, err = d.names(len(record), target)
+	if err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// Read returns the next record, io.EOF is returned when there are no more
+func (rr *recordReader) Read() ([]string, error) {
+	if rr.first != nil {
+		record := rr.first
+		rr.first = nil
+		return record, nil
+	}
+	return rr.read()
+}
+
+func (rr *recordReader) read() ([]string, error) {
+	record, err := rr.cr.Read()
+	if err != nil || rr.quote == 0 {
+		return record, err
+	}
+
+	for i, field := range record {
+		record[i] = swapBytes(field, rr.quote, '"')
+	}
+	return record, nil
+}
+
+// swapReader exchanges two ascii characters in the data read from r
+type swapReader struct {
+	r    io.Reader
+	a, b byte
+}
+
+func (s *swapReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case s.a:
+			p[i] = s.b
+		case s.b:
+			p[i] = s.a
+		}
+	}
+	return n, err
+}
+
+func swapBytes(s string, a, b byte) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case rune(a):
+			return rune(b)
+		case rune(b):
+			return rune(a)
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadDialect(t *testing.T) {
+	saved := Dialect{Delimiter: ";", Quote: "'"}
+	tests := []struct {
+		format string
+		form   map[string][]string
+		want   Dialect
+	}{
+		{"", nil, saved},
+		{formatCSV, nil, saved},
+		{formatTSV, nil, Dialect{Delimiter: "\t", Quote: "'"}},
+		{formatCSV, map[string][]string{"delimiter": {"|"}}, Dialect{Delimiter: "|", Quote: "'"}},
+		{formatCSV, map[string][]string{"delimiter": {`\t`}}, Dialect{Delimiter: "\t", Quote: "'"}},
+		{formatTSV, map[string][]string{"delimiter": {","}}, Dialect{Delimiter: ",", Quote: "'"}},
+		{formatCSV, map[string][]string{"header": {"absent"}, "columns": {"a,b"}}, Dialect{Delimiter: ";", Quote: "'", NoHeader: true, Columns: []string{"a", "b"}}},
+		{formatNDJSON, map[string][]string{"delimiter": {"|"}}, saved},
+	}
+
+	for _, tt := range tests {
+		got, err := readDialect(saved, tt.format, tt.form)
+		if err != nil {
+			t.Errorf("readDialect(%q, %v): %v", tt.format, tt.form, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readDialect(%q, %v) = %+v, want %+v", tt.format, tt.form, got, tt.want)
+		}
+	}
+}
+
+func TestReadDialectErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		form   map[string][]string
+		err    string
+	}{
+		{"xls", nil, `unknown format "xls"`},
+		{formatCSV, map[string][]string{"delimiter": {";;"}}, "should be a single character"},
+		{formatCSV, map[string][]string{"quote": {";"}, "delimiter": {";"}}, "quote can't be the same"},
+		{formatCSV, map[string][]string{"header": {"maybe"}}, `header "maybe" should be true or false`},
+	}
+
+	for _, tt := range tests {
+		_, err := readDialect(Dialect{}, tt.format, tt.form)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("readDialect(%q, %v) error %v, want %q", tt.format, tt.form, err, tt.err)
+		}
+	}
+}
+
+func TestDialectReader(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		data    string
+		header  []string
+		rows    [][]string
+	}{
+		{Dialect{}, "a,b\n1,\"x,y\"\n", []string{"a", "b"}, [][]string{{"1", "x,y"}}},
+		{Dialect{Delimiter: "\t"}, "a\tb\n1\tx\n", []string{"a", "b"}, [][]string{{"1", "x"}}},
+		{Dialect{Quote: "'"}, "a,b\n'1,5','say \"hi\"'\n", []string{"a", "b"}, [][]string{{"1,5", `say "hi"`}}},
+		{Dialect{Comment: "#"}, "a,b\n# skipped\n1,2\n", []string{"a", "b"}, [][]string{{"1", "2"}}},
+		{Dialect{NoHeader: true}, "1,2\n3,4\n", []string{"column_1", "column_2"}, [][]string{{"1", "2"}, {"3", "4"}}},
+		{Dialect{NoHeader: true, Columns: []string{"a", "y", "b"}}, "1,2\n", []string{"a", "b"}, [][]string{{"1", "2"}}},
+	}
+
+	for _, tt := range tests {
+		rr, err := tt.dialect.newReader(strings.NewReader(tt.data), "y")
+		if err != nil {
+			t.Errorf("%+v: %v", tt.dialect, err)
+			continue
+		}
+		var rows [][]string
+		for {
+			row, err := rr.Read()
+			if err != nil {
+				break
+			}
+			rows = append(rows, row)
+		}
+		if !reflect.DeepEqual(rr.Header, tt.header) || !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%+v: header %q rows %q, want %q %q", tt.dialect, rr.Header, rows, tt.header, tt.rows)
+		}
+	}
+}
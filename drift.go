@@ -0,0 +1,387 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// driftOther is the bin of categorical values and labels not among the most
+// frequent values of the training data
+const driftOther = "(other)"
+
+// driftSmoothing replaces empty bins when computing the PSI, which is
+// undefined for proportions of 0
+const driftSmoothing = 1e-4
+
+// Drift compares the rows of recent predict requests to the training data of a
+// model. Numeric columns are scored by the population stability index (PSI)
+// over bins between the quantiles of the training profile, categorical columns
+// and the predicted labels by the largest difference in the share of any value
+// (L-infinity distance). Columns scoring above the thresholds are marked as
+// drifted.
+type Drift struct {
+	ModelID    string        `json:"model_id"`
+	Rows       int           `json:"rows"`  // rows in the window
+	Since      time.Time     `json:"since"` // when the first row of the window was seen
+	Window     int           `json:"window"`
+	Thresholds DriftLimits   `json:"thresholds"`
+	Columns    []ColumnDrift `json:"columns"`
+	Prediction ColumnDrift   `json:"prediction"`
+}
+
+// DriftLimits are the scores above which a column has drifted, PSI for numeric
+// columns and Distance for categorical columns and predictions
+type DriftLimits struct {
+	PSI      float64 `json:"psi"`
+	Distance float64 `json:"distance"`
+}
+
+// ColumnDrift compares the values of a column in the window to the training
+// data, the shares of each bin are of the non-missing values
+type ColumnDrift struct {
+	Name                string     `json:"name"`
+	Type                string     `json:"type"`
+	Metric              string     `json:"metric"` // psi or distance
+	Score               float64    `json:"score"`
+	Drifted             bool       `json:"drifted"`
+	MissingRate         float64    `json:"missing_rate"`
+	TrainingMissingRate float64    `json:"training_missing_rate"`
+	Bins                []DriftBin `json:"bins"`
+}
+
+// DriftBin is the share of values falling in a bin, in the training data and in
+// the window. Numeric bins are labeled by their upper bound, "<= 1.6", the last
+// bin by its lower bound, "> 6.7".
+type DriftBin struct {
+	Bin      string  `json:"bin"`
+	Training float64 `json:"training"`
+	Window   float64 `json:"window"`
+}
+
+// driftMonitor accumulates the binned values of the rows of predict requests
+// and the most likely predicted labels for a model. Counts are kept in two
+// generations of window rows each, once the current generation is full the
+// scores are checked against the thresholds and the previous generation is
+// dropped, so reports cover between window and 2*window rows.
+type driftMonitor struct {
+	schema  Schema
+	columns []*driftColumn
+	label   *driftColumn
+	window  int
+	limits  DriftLimits
+
+	mu    sync.Mutex // protects the counts and fields below
+	rows  [2]int     // rows in the previous and current generation
+	since [2]time.Time
+}
+
+// driftColumn holds the bins of a column: numeric values are binned by edges,
+// a value falls in the first bin whose edge is not less than it, or the last
+// bin, categorical values are binned by value, with unknown values in the last
+// bin
+type driftColumn struct {
+	name     string
+	typ      string
+	edges    []float64
+	values   map[string]int
+	bins     []string
+	training []float64 // share of each bin in the training data
+	missing  float64   // training missing rate
+
+	counts  [2][]int // previous and current generation
+	missed  [2]int
+	present [2]int
+}
+
+// newDriftMonitor returns a monitor for the columns of the profile, text,
+// datetime, and ignored columns are not monitored
+func newDriftMonitor(s Schema, p DataProfile, window int, limits DriftLimits) *driftMonitor {
+	d := &driftMonitor{schema: s, window: window, limits: limits}
+	for _, col := range p.Columns {
+		var c *driftColumn
+		switch {
+		case col.Type == typeNumeric && col.Numeric != nil:
+			c = numericDriftColumn(col)
+		case col.Type == typeCategorical && col.Categorical != nil:
+			c = categoricalDriftColumn(col, p.Rows, nil)
+		default:
+			continue
+		}
+		d.columns = append(d.columns, c)
+	}
+	if p.Label.Categorical != nil {
+		d.label = categoricalDriftColumn(p.Label, p.Rows, normalizeLabel)
+	}
+	d.since[1] = time.Now()
+	return d
+}
+
+// numericDriftColumn bins a numeric column at the quantiles of the profile, the
+// share of the training data in each bin follows from the quantiles. Repeated
+// quantiles, common for discrete values, are merged into a single bin.
+func numericDriftColumn(p ColumnProfile) *driftColumn {
+	c := &driftColumn{name: p.Name, typ: p.Type, missing: p.MissingRate}
+	var level float64
+	for _, q := range profileQuantiles {
+		edge, ok := p.Numeric.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)]
+		if !ok {
+			continue
+		}
+		share := q - level
+		level = q
+		if n := len(c.edges); n > 0 && edge <= c.edges[n-1] {
+			c.training[n-1] += share
+			continue
+		}
+		c.edges = append(c.edges, edge)
+		c.bins = append(c.bins, "<= "+strconv.FormatFloat(edge, 'g', -1, 64))
+		c.training = append(c.training, share)
+	}
+	if n := len(c.edges); n > 0 {
+		c.bins = append(c.bins, "> "+strconv.FormatFloat(c.edges[n-1], 'g', -1, 64))
+	} else {
+		c.bins = append(c.bins, "all")
+	}
+	c.training = append(c.training, 1-level)
+	c.reset()
+	return c
+}
+
+// categoricalDriftColumn bins the most frequent values of a column, the
+// remaining values share a bin. rows is the number of training rows, normalize,
+// if not nil, is applied to values before they are looked up.
+func categoricalDriftColumn(p ColumnProfile, rows int, normalize func(string) string) *driftColumn {
+	c := &driftColumn{name: p.Name, typ: p.Type, missing: p.MissingRate, values: make(map[string]int)}
+	present := float64(rows - p.Missing)
+	if present <= 0 {
+		present = 1
+	}
+
+	// values beyond the most frequent are not in the profile, their share
+	// falls into the other bin
+	var listed float64
+	for _, v := range p.Categorical.Top {
+		val := v.Value
+		if normalize != nil {
+			val = normalize(val)
+		}
+		if _, ok := c.values[val]; ok {
+			continue
+		}
+		share := float64(v.Count) / present
+		c.values[val] = len(c.bins)
+		c.bins = append(c.bins, val)
+		c.training = append(c.training, share)
+		listed += share
+	}
+	c.bins = append(c.bins, driftOther)
+	c.training = append(c.training, math.Max(1-listed, 0))
+	c.reset()
+	return c
+}
+
+// reset drops the counts of the previous generation, the current generation
+// becomes the previous one
+func (c *driftColumn) reset() {
+	c.counts[0], c.counts[1] = c.counts[1], make([]int, len(c.bins))
+	if c.counts[0] == nil {
+		c.counts[0] = make([]int, len(c.bins))
+	}
+	c.missed[0], c.missed[1] = c.missed[1], 0
+	c.present[0], c.present[1] = c.present[1], 0
+}
+
+// bin returns the bin of a value, false is returned for missing values and
+// values that are not numbers in numeric columns
+func (c *driftColumn) bin(s Schema, raw interface{}) (int, bool) {
+	val, ok := s.parseColumn(c.name, raw)
+	if !ok {
+		return 0, false
+	}
+	if c.values != nil {
+		i, ok := c.values[categoricalValue(raw)]
+		if !ok {
+			i = len(c.bins) - 1
+		}
+		return i, true
+	}
+	num, isNum := val.(float64)
+	if !isNum {
+		return 0, false
+	}
+	return sort.SearchFloat64s(c.edges, num), true
+}
+
+// add counts a value in the current generation
+func (c *driftColumn) add(s Schema, raw interface{}) {
+	i, ok := c.bin(s, raw)
+	if !ok {
+		c.missed[1]++
+		return
+	}
+	c.counts[1][i]++
+	c.present[1]++
+}
+
+// drift scores the values of both generations against the training data
+func (c *driftColumn) drift(limits DriftLimits) ColumnDrift {
+	d := ColumnDrift{
+		Name:                c.name,
+		Type:                c.typ,
+		Metric:              "psi",
+		TrainingMissingRate: c.missing,
+		Bins:                make([]DriftBin, len(c.bins)),
+	}
+	if c.values != nil {
+		d.Metric = "distance"
+	}
+
+	present := c.present[0] + c.present[1]
+	if total := present + c.missed[0] + c.missed[1]; total > 0 {
+		d.MissingRate = float64(c.missed[0]+c.missed[1]) / float64(total)
+	}
+	for i, bin := range c.bins {
+		d.Bins[i] = DriftBin{Bin: bin, Training: c.training[i]}
+		if present > 0 {
+			d.Bins[i].Window = float64(c.counts[0][i]+c.counts[1][i]) / float64(present)
+		}
+	}
+	if present == 0 {
+		return d
+	}
+
+	if d.Metric == "psi" {
+		for _, b := range d.Bins {
+			expected, actual := math.Max(b.Training, driftSmoothing), math.Max(b.Window, driftSmoothing)
+			d.Score += (actual - expected) * math.Log(actual/expected)
+		}
+		d.Drifted = d.Score > limits.PSI
+		return d
+	}
+	for _, b := range d.Bins {
+		d.Score = math.Max(d.Score, math.Abs(b.Window-b.Training))
+	}
+	d.Drifted = d.Score > limits.Distance
+	return d
+}
+
+// normalizeLabel formats numeric labels the same way regardless of how they
+// were written, "1.0" and "1" are the same label
+func normalizeLabel(label string) string {
+	num, err := strconv.ParseFloat(label, 64)
+	if err != nil {
+		return label
+	}
+	return strconv.FormatFloat(num, 'f', -1, 64)
+}
+
+// observe counts the values of a row of a predict request, after it has been
+// flattened and preprocessed. It is safe to call on a nil monitor.
+func (d *driftMonitor) observe(row map[string]interface{}) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range d.columns {
+		c.add(d.schema, row[c.name])
+	}
+	d.rows[1]++
+	if d.rows[1] >= d.window {
+		d.rotate()
+	}
+}
+
+// observePredictions counts the most likely label of each prediction. It is
+// safe to call on a nil monitor.
+func (d *driftMonitor) observePredictions(labels []map[string]float64) {
+	if d == nil || d.label == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, probs := range labels {
+		d.label.add(d.schema, normalizeLabel(mostLikely(probs)))
+	}
+}
+
+// rotate logs a warning for each column that drifted in the last window rows,
+// then starts a new generation
+func (d *driftMonitor) rotate() {
+	report := d.report()
+	for _, c := range append(report.Columns, report.Prediction) {
+		if c.Drifted {
+			log.Warningf("input drift for column %s: %s %.4f over %d rows", c.Name, c.Metric, c.Score, report.Rows)
+		}
+	}
+
+	for _, c := range d.columns {
+		c.reset()
+	}
+	if d.label != nil {
+		d.label.reset()
+	}
+	d.rows[0], d.rows[1] = d.rows[1], 0
+	d.since[0], d.since[1] = d.since[1], time.Now()
+}
+
+// report returns the drift of the rows in the window, d.mu should be held
+func (d *driftMonitor) report() Drift {
+	r := Drift{
+		Rows:       d.rows[0] + d.rows[1],
+		Since:      d.since[1],
+		Window:     d.window,
+		Thresholds: d.limits,
+		Columns:    make([]ColumnDrift, len(d.columns)),
+	}
+	if d.rows[0] > 0 {
+		r.Since = d.since[0]
+	}
+	for i, c := range d.columns {
+		r.Columns[i] = c.drift(d.limits)
+	}
+	if d.label != nil {
+		r.Prediction = d.label.drift(d.limits)
+		r.Prediction.Name = "prediction"
+	}
+	return r
+}
+
+// Drift compares the rows of recent predict requests for the model to its
+// training data, see Drift. Rows are counted while the model is loaded, an
+// error satisfying os.IsNotExist is returned for models fit without a training
+// data profile.
+func (m *Model) Drift() (Drift, error) {
+	d, err := m.driftMonitor()
+	if err != nil {
+		return Drift{}, err
+	}
+
+	d.mu.Lock()
+	r := d.report()
+	d.mu.Unlock()
+
+	r.ModelID = m.ID
+	return r, nil
+}
+
+// driftMonitor returns the drift monitor of the model, creating it from the
+// training data profile on first use
+func (m *Model) driftMonitor() (*driftMonitor, error) {
+	m.driftOnce.Do(func() {
+		var p DataProfile
+		p, m.driftErr = m.Profile()
+		if m.driftErr != nil {
+			return
+		}
+		m.drift = newDriftMonitor(m.Schema, p, *driftWindow, DriftLimits{*driftPSI, *driftDistance})
+	})
+	return m.drift, m.driftErr
+}
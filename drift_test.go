@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// numericProfile returns the profile of a numeric column with the quantiles
+func numericProfile(name string, quantiles map[string]float64) ColumnProfile {
+	return ColumnProfile{Name: name, Type: typeNumeric, Numeric: &NumericProfile{Quantiles: quantiles}}
+}
+
+func TestNumericDriftColumnBins(t *testing.T) {
+	c := numericDriftColumn(numericProfile("x", map[string]float64{"0.25": 1, "0.5": 2, "0.75": 3}))
+	if want := []string{"<= 1", "<= 2", "<= 3", "> 3"}; !reflect.DeepEqual(c.bins, want) {
+		t.Errorf("bins %v, want %v", c.bins, want)
+	}
+	if want := []float64{0.25, 0.25, 0.25, 0.25}; !reflect.DeepEqual(c.training, want) {
+		t.Errorf("training shares %v, want %v", c.training, want)
+	}
+
+	// repeated quantiles of discrete values share a bin
+	c = numericDriftColumn(numericProfile("n", map[string]float64{"0.01": 0, "0.05": 0, "0.25": 0, "0.5": 1, "0.75": 1, "0.95": 1, "0.99": 4}))
+	if want := []string{"<= 0", "<= 1", "<= 4", "> 4"}; !reflect.DeepEqual(c.bins, want) {
+		t.Errorf("bins %v, want %v", c.bins, want)
+	}
+	for i, want := range []float64{0.25, 0.7, 0.04, 0.01} {
+		if !near(c.training[i], want) {
+			t.Errorf("training shares %v, want bin %d to be %v", c.training, i, want)
+			break
+		}
+	}
+
+	c = numericDriftColumn(numericProfile("empty", nil))
+	if !reflect.DeepEqual(c.bins, []string{"all"}) || !reflect.DeepEqual(c.training, []float64{1}) {
+		t.Errorf("bins %v shares %v without quantiles, want a single bin", c.bins, c.training)
+	}
+}
+
+func TestNumericDriftPSI(t *testing.T) {
+	s := Schema{Types: map[string]string{"x": typeNumeric}}
+	limits := DriftLimits{PSI: 0.2, Distance: 0.1}
+	tests := []struct {
+		values  []interface{}
+		score   float64
+		missing float64
+	}{
+		{[]interface{}{0.5, 1.5, 2.5, 3.5}, 0, 0},
+		{[]interface{}{"0.5", 1.5, 2.5, 3.5, nil}, 0, 0.2},
+		{[]interface{}{4.0, 5.0, 6.0, "x"}, 6.90541, 0.25},
+	}
+
+	for _, tt := range tests {
+		c := numericDriftColumn(numericProfile("x", map[string]float64{"0.25": 1, "0.5": 2, "0.75": 3}))
+		for _, val := range tt.values {
+			c.add(s, val)
+		}
+		d := c.drift(limits)
+		if d.Metric != "psi" || !near(d.Score, tt.score) || d.Drifted != (tt.score > limits.PSI) {
+			t.Errorf("%v: %s %v drifted %v, want psi %v", tt.values, d.Metric, d.Score, d.Drifted, tt.score)
+		}
+		if !near(d.MissingRate, tt.missing) {
+			t.Errorf("%v: missing rate %v, want %v", tt.values, d.MissingRate, tt.missing)
+		}
+	}
+}
+
+func TestCategoricalDriftDistance(t *testing.T) {
+	p := ColumnProfile{
+		Name:        "color",
+		Type:        typeCategorical,
+		Missing:     1,
+		Categorical: &CategoricalProfile{Top: []valueCount{{"red", 6}, {"blue", 3}}},
+	}
+	c := categoricalDriftColumn(p, 10, nil)
+	if want := []string{"red", "blue", driftOther}; !reflect.DeepEqual(c.bins, want) {
+		t.Errorf("bins %v, want %v", c.bins, want)
+	}
+
+	s := Schema{Types: map[string]string{"color": typeCategorical}}
+	for _, val := range []interface{}{"red", "green", "green", nil} {
+		c.add(s, val)
+	}
+	d := c.drift(DriftLimits{PSI: 0.2, Distance: 0.1})
+	if d.Metric != "distance" || !near(d.Score, 2.0/3) || !d.Drifted {
+		t.Errorf("%s %v drifted %v, want distance 2/3", d.Metric, d.Score, d.Drifted)
+	}
+	if !near(d.MissingRate, 0.25) {
+		t.Errorf("missing rate %v, want 0.25", d.MissingRate)
+	}
+	if other := d.Bins[2]; !near(other.Training, 0) || !near(other.Window, 2.0/3) {
+		t.Errorf("other bin %+v, want 0 in training and 2/3 in the window", other)
+	}
+}
+
+func TestDriftMonitorWindow(t *testing.T) {
+	p := DataProfile{
+		Rows:    4,
+		Columns: []ColumnProfile{numericProfile("x", map[string]float64{"0.5": 2})},
+		Label: ColumnProfile{
+			Name:        "label",
+			Type:        typeCategorical,
+			Categorical: &CategoricalProfile{Top: []valueCount{{"1", 2}, {"0.0", 2}}},
+		},
+	}
+	s := Schema{Types: map[string]string{"x": typeNumeric}}
+	d := newDriftMonitor(s, p, 2, DriftLimits{PSI: 0.2, Distance: 0.1})
+
+	for _, x := range []float64{1, 3, 1, 3, 10} {
+		d.observe(map[string]interface{}{"x": x})
+	}
+	d.observePredictions([]map[string]float64{{"1.0": 0.9, "0.0": 0.1}, {"1.0": 0.2, "0.0": 0.8}})
+
+	r := d.report()
+	if r.Rows != 3 {
+		t.Errorf("%d rows in the window, want the last full generation and 1 row", r.Rows)
+	}
+	if x := r.Columns[0]; x.Bins[0].Window != 1.0/3 || x.Bins[1].Window != 2.0/3 {
+		t.Errorf("window shares %+v, want 1/3 and 2/3", x.Bins)
+	}
+	if pred := r.Prediction; pred.Name != "prediction" || pred.Score != 0 {
+		t.Errorf("prediction drift %+v, want no drift once labels are normalized", pred)
+	}
+
+	var nilMonitor *driftMonitor
+	nilMonitor.observe(map[string]interface{}{"x": 1.0})
+	nilMonitor.observePredictions([]map[string]float64{{"a": 1}})
+}
+
+func TestNormalizeLabel(t *testing.T) {
+	for label, want := range map[string]string{"1.0": "1", "1": "1", "-2.50": "-2.5", "yes": "yes", "": ""} {
+		if got := normalizeLabel(label); got != want {
+			t.Errorf("normalizeLabel(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
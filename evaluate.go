@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Evaluation is the performance of a fitted model on labeled data supplied after
+// the model was fit, see Model.Evaluate. Evaluations are saved in
+// <model_id>.evaluations.json so they can be compared over time.
+type Evaluation struct {
+	ID              string                        `json:"evaluation_id"`
+	ModelID         string                        `json:"model_id"`
+	Name            string                        `json:"name,omitempty"`
+	Date            time.Time                     `json:"created_at"`
+	Rows            int                           `json:"rows"`
+	ConfusionMatrix map[string]map[string]float64 `json:"confusion_matrix"`
+	Metrics         Metrics                       `json:"metrics"`
+}
+
+// Evaluate predicts the labeled rows of d with the running model and compares
+// the predicted labels, the labels with the highest probability, to the true
+// labels. The evaluation is saved with the model.
+func (m *Model) Evaluate(name string, d ModelReq) (Evaluation, error) {
+	pred := m.Predict(d)
+	if len(pred.Labels) != len(d.Data) {
+		return Evaluation{}, fmt.Errorf("mlserver: model returned %d predictions for %d rows", len(pred.Labels), len(d.Data))
+	}
+
+	e := Evaluation{
+		ID:      uuid.New(),
+		ModelID: m.ID,
+		Name:    name,
+		Date:    time.Now().UTC(),
+		Rows:    len(d.Data),
+	}
+	e.ConfusionMatrix, e.Metrics = evaluate(d.Labels, pred.Labels)
+
+	m.evalLock.Lock()
+	defer m.evalLock.Unlock()
+
+	evals, err := m.Evaluations()
+	if err != nil {
+		return Evaluation{}, err
+	}
+	err = writeJSONFile(m.evaluationsPath(), append(evals, e))
+	if err == nil {
+		err = m.persist(filepath.Base(m.evaluationsPath()))
+	}
+	return e, err
+}
+
+// Evaluations returns the saved evaluations of the model, oldest first
+func (m *Model) Evaluations() ([]Evaluation, error) {
+	evals := []Evaluation{}
+	err := readJSONFile(m.evaluationsPath(), &evals)
+	if os.IsNotExist(err) {
+		return evals, nil
+	}
+	return evals, err
+}
+
+func (m *Model) evaluationsPath() string {
+	return filepath.Join(m.dir, m.ID+".evaluations.json")
+}
+
+// evaluate computes the confusion matrix and metrics for the predicted class
+// probabilities of each row. Numeric labels are matched to the classes by
+// value since fit.py writes them as floats, a label of 1 is predicted as 1.0.
+// R2 and RMSE are computed when every label is numeric.
+func evaluate(labels []interface{}, probs []map[string]float64) (map[string]map[string]float64, Metrics) {
+	classes := make(map[string]bool)
+	numericClasses := make(map[float64]string)
+	for _, p := range probs {
+		for class := range p {
+			if !classes[class] {
+				classes[class] = true
+				if num, err := strconv.ParseFloat(class, 64); err == nil {
+					numericClasses[num] = class
+				}
+			}
+		}
+	}
+
+	truth := make([]string, len(labels))
+	predicted := make([]string, len(labels))
+	for i, label := range labels {
+		truth[i] = categoricalValue(label)
+		if num, err := strconv.ParseFloat(truth[i], 64); err == nil {
+			if class, ok := numericClasses[num]; ok {
+				truth[i] = class
+			}
+		}
+		predicted[i] = mostLikely(probs[i])
+	}
+
+	// the labels found in the data or predictions, as sklearn reports
+	var names []string
+	seen := make(map[string]bool)
+	for _, label := range append(append([]string{}, truth...), predicted...) {
+		if !seen[label] {
+			seen[label] = true
+			names = append(names, label)
+		}
+	}
+	sort.Strings(names)
+
+	cm := make(map[string]map[string]float64)
+	for _, name := range names {
+		cm[name] = make(map[string]float64)
+		for _, other := range names {
+			cm[name][other] = 0
+		}
+	}
+	correct := 0
+	for i := range truth {
+		cm[truth[i]][predicted[i]]++
+		if truth[i] == predicted[i] {
+			correct++
+		}
+	}
+
+	n := float64(len(truth))
+	metrics := Metrics{
+		Accuracy: float64(correct) / n,
+		Classes:  make(map[string]ClassMetrics),
+	}
+	for _, name := range names {
+		var support, predictedCount float64
+		for _, other := range names {
+			support += cm[name][other]
+			predictedCount += cm[other][name]
+		}
+		c := classMetrics(cm[name][name], predictedCount, support)
+		metrics.Classes[name] = c
+
+		k := float64(len(names))
+		metrics.MacroAvg.Precision += c.Precision / k
+		metrics.MacroAvg.Recall += c.Recall / k
+		metrics.MacroAvg.F1 += c.F1 / k
+		metrics.WeightedAvg.Precision += c.Precision * support / n
+		metrics.WeightedAvg.Recall += c.Recall * support / n
+		metrics.WeightedAvg.F1 += c.F1 * support / n
+	}
+	metrics.MacroAvg.Support = len(truth)
+	metrics.WeightedAvg.Support = len(truth)
+
+	metrics.ROCAUC = meanROCAUC(truth, probs, classes)
+	metrics.LogLoss = logLoss(truth, probs)
+	metrics.R2, metrics.RMSE = regressionMetrics(truth, predicted)
+
+	return cm, metrics
+}
+
+// mostLikely returns the class with the highest probability, ties go to the
+// class that sorts first
+func mostLikely(p map[string]float64) string {
+	best, bestProb := "", math.Inf(-1)
+	for class, prob := range p {
+		if prob > bestProb || (prob == bestProb && class < best) {
+			best, bestProb = class, prob
+		}
+	}
+	return best
+}
+
+// classMetrics returns the precision, recall, and F1 score of a class given the
+// number of correct predictions of the class, the number of rows predicted as
+// the class, and the number of rows of the class. Undefined ratios are 0.
+func classMetrics(correct, predicted, support float64) ClassMetrics {
+	c := ClassMetrics{Support: int(support)}
+	if predicted > 0 {
+		c.Precision = correct / predicted
+	}
+	if support > 0 {
+		c.Recall = correct / support
+	}
+	if c.Precision+c.Recall > 0 {
+		c.F1 = 2 * c.Precision * c.Recall / (c.Precision + c.Recall)
+	}
+	return c
+}
+
+// meanROCAUC returns the mean one vs rest ROC AUC of the classes, classes that
+// are absent from the labels or are the only label are skipped, nil is returned
+// if every class is skipped
+func meanROCAUC(truth []string, probs []map[string]float64, classes map[string]bool) *float64 {
+	var sum float64
+	var count int
+	for class := range classes {
+		scores := make([]float64, len(truth))
+		positive := make([]bool, len(truth))
+		for i := range truth {
+			scores[i] = probs[i][class]
+			positive[i] = truth[i] == class
+		}
+		auc, ok := rocAUC(scores, positive)
+		if ok {
+			sum += auc
+			count++
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	mean := sum / float64(count)
+	return &mean
+}
+
+// rocAUC returns the area under the ROC curve, the probability that a randomly
+// chosen positive row scores higher than a randomly chosen negative row, from
+// the ranks of the scores, tied scores share their mean rank. false is returned
+// unless there are both positive and negative rows.
+func rocAUC(scores []float64, positive []bool) (float64, bool) {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(byScore{order, scores})
+
+	var rankSum, positives float64
+	for i := 0; i < len(order); {
+		j := i
+		for j < len(order) && scores[order[j]] == scores[order[i]] {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // mean of the ranks i+1 through j
+		for _, row := range order[i:j] {
+			if positive[row] {
+				rankSum += rank
+				positives++
+			}
+		}
+		i = j
+	}
+
+	negatives := float64(len(scores)) - positives
+	if positives == 0 || negatives == 0 {
+		return 0, false
+	}
+	return (rankSum - positives*(positives+1)/2) / (positives * negatives), true
+}
+
+type byScore struct {
+	rows   []int
+	scores []float64
+}
+
+func (s byScore) Len() int           { return len(s.rows) }
+func (s byScore) Swap(i, j int)      { s.rows[i], s.rows[j] = s.rows[j], s.rows[i] }
+func (s byScore) Less(i, j int) bool { return s.scores[s.rows[i]] < s.scores[s.rows[j]] }
+
+// minProb bounds the probabilities used by logLoss, as sklearn does, so a
+// confident wrong prediction has a large but finite loss
+const minProb = 1e-15
+
+// logLoss returns the mean negative log of the probability predicted for the
+// true label of each row
+func logLoss(truth []string, probs []map[string]float64) *float64 {
+	var loss float64
+	for i, label := range truth {
+		p := math.Min(math.Max(probs[i][label], minProb), 1-minProb)
+		loss -= math.Log(p)
+	}
+	loss /= float64(len(truth))
+	return &loss
+}
+
+// regressionMetrics returns R² and the root mean squared error of numeric
+// predicted labels, nil is returned for either if a label is not a number. R²
+// is nil when every true label is the same.
+func regressionMetrics(truth, predicted []string) (*float64, *float64) {
+	y := make([]float64, len(truth))
+	yHat := make([]float64, len(truth))
+	var mean float64
+	for i := range truth {
+		var err error
+		y[i], err = strconv.ParseFloat(truth[i], 64)
+		if err != nil {
+			return nil, nil
+		}
+		yHat[i], err = strconv.ParseFloat(predicted[i], 64)
+		if err != nil {
+			return nil, nil
+		}
+		mean += y[i]
+	}
+	mean /= float64(len(y))
+
+	var ssRes, ssTot float64
+	for i := range y {
+		ssRes += (y[i] - yHat[i]) * (y[i] - yHat[i])
+		ssTot += (y[i] - mean) * (y[i] - mean)
+	}
+
+	rmse := math.Sqrt(ssRes / float64(len(y)))
+	if ssTot == 0 {
+		return nil, &rmse
+	}
+	r2 := 1 - ssRes/ssTot
+	return &r2, &rmse
+}
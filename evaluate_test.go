@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// near reports if a is within 1e-4 of b
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+func TestEvaluate(t *testing.T) {
+	labels := []interface{}{"a", "a", "b", "b"}
+	probs := []map[string]float64{
+		{"a": 0.9, "b": 0.1},
+		{"a": 0.4, "b": 0.6},
+		{"a": 0.35, "b": 0.65},
+		{"a": 0.2, "b": 0.8},
+	}
+	cm, metrics := evaluate(labels, probs)
+
+	wantCM := map[string]map[string]float64{
+		"a": {"a": 1, "b": 1},
+		"b": {"a": 0, "b": 2},
+	}
+	if !reflect.DeepEqual(cm, wantCM) {
+		t.Errorf("confusion matrix %v, want %v", cm, wantCM)
+	}
+
+	a, b := metrics.Classes["a"], metrics.Classes["b"]
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"accuracy", metrics.Accuracy, 0.75},
+		{"a precision", a.Precision, 1},
+		{"a recall", a.Recall, 0.5},
+		{"a f1", a.F1, 2.0 / 3},
+		{"b precision", b.Precision, 2.0 / 3},
+		{"b recall", b.Recall, 1},
+		{"b f1", b.F1, 0.8},
+		{"macro precision", metrics.MacroAvg.Precision, 5.0 / 6},
+		{"macro recall", metrics.MacroAvg.Recall, 0.75},
+		{"macro f1", metrics.MacroAvg.F1, 11.0 / 15},
+		{"weighted f1", metrics.WeightedAvg.F1, 11.0 / 15},
+		{"roc auc", *metrics.ROCAUC, 1},
+		{"log loss", *metrics.LogLoss, 0.41889},
+	} {
+		if !near(c.got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if a.Support != 2 || metrics.MacroAvg.Support != 4 {
+		t.Errorf("support %d and %d, want 2 and 4", a.Support, metrics.MacroAvg.Support)
+	}
+	if metrics.R2 != nil || metrics.RMSE != nil {
+		t.Errorf("r2 %v and rmse %v for categorical labels, want nil", metrics.R2, metrics.RMSE)
+	}
+}
+
+func TestEvaluateNumericLabels(t *testing.T) {
+	// fit.py writes numeric classes as floats
+	labels := []interface{}{1.0, "2", 2.0}
+	probs := []map[string]float64{
+		{"1.0": 0.8, "2.0": 0.2},
+		{"1.0": 0.3, "2.0": 0.7},
+		{"1.0": 0.6, "2.0": 0.4},
+	}
+	cm, metrics := evaluate(labels, probs)
+
+	if cm["2.0"]["1.0"] != 1 || cm["1.0"]["1.0"] != 1 || len(cm) != 2 {
+		t.Errorf("confusion matrix %v, want labels matched to the classes", cm)
+	}
+	if !near(metrics.Accuracy, 2.0/3) {
+		t.Errorf("accuracy %v, want 2/3", metrics.Accuracy)
+	}
+	if metrics.R2 == nil || !near(*metrics.R2, -0.5) {
+		t.Errorf("r2 %v, want -0.5", metrics.R2)
+	}
+	if metrics.RMSE == nil || !near(*metrics.RMSE, math.Sqrt(1.0/3)) {
+		t.Errorf("rmse %v, want %v", metrics.RMSE, math.Sqrt(1.0/3))
+	}
+}
+
+func TestRegressionMetricsConstantLabels(t *testing.T) {
+	r2, rmse := regressionMetrics([]string{"3", "3"}, []string{"3", "5"})
+	if r2 != nil || rmse == nil || !near(*rmse, math.Sqrt(2)) {
+		t.Errorf("r2 %v rmse %v, want nil and %v", r2, rmse, math.Sqrt(2))
+	}
+}
+
+func TestROCAUC(t *testing.T) {
+	tests := []struct {
+		scores   []float64
+		positive []bool
+		auc      float64
+		ok       bool
+	}{
+		{[]float64{0.1, 0.4, 0.35, 0.8}, []bool{false, false, true, true}, 0.75, true},
+		{[]float64{0.5, 0.5}, []bool{true, false}, 0.5, true},
+		{[]float64{0.9, 0.1}, []bool{false, true}, 0, true},
+		{[]float64{0.2, 0.3}, []bool{true, true}, 0, false},
+		{nil, nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		auc, ok := rocAUC(tt.scores, tt.positive)
+		if ok != tt.ok || !near(auc, tt.auc) {
+			t.Errorf("rocAUC(%v, %v) = %v, %v, want %v, %v", tt.scores, tt.positive, auc, ok, tt.auc, tt.ok)
+		}
+	}
+}
+
+func TestMeanROCAUCSkipsAbsentClasses(t *testing.T) {
+	truth := []string{"a", "a"}
+	probs := []map[string]float64{{"a": 0.7, "b": 0.3}, {"a": 0.6, "b": 0.4}}
+	if auc := meanROCAUC(truth, probs, map[string]bool{"a": true, "b": true}); auc != nil {
+		t.Errorf("roc auc %v with a single label, want nil", *auc)
+	}
+}
+
+func TestLogLossBounded(t *testing.T) {
+	loss := logLoss([]string{"a"}, []map[string]float64{{"a": 0, "b": 1}})
+	if !near(*loss, -math.Log(minProb)) {
+		t.Errorf("log loss %v, want %v", *loss, -math.Log(minProb))
+	}
+}
+
+func TestMostLikely(t *testing.T) {
+	tests := []struct {
+		probs map[string]float64
+		want  string
+	}{
+		{map[string]float64{"a": 0.2, "b": 0.8}, "b"},
+		{map[string]float64{"b": 0.5, "a": 0.5}, "a"},
+		{map[string]float64{}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := mostLikely(tt.probs); got != tt.want {
+			t.Errorf("mostLikely(%v) = %q, want %q", tt.probs, got, tt.want)
+		}
+	}
+}
+
+func TestClassMetricsUndefined(t *testing.T) {
+	c := classMetrics(0, 0, 0)
+	if c != (ClassMetrics{}) {
+		t.Errorf("metrics %+v without predictions or rows, want zeros", c)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultExplainTop is the number of input columns listed in each explanation
+// unless the predict request sets explain_top
+const defaultExplainTop = 5
+
+// explainable lists the algorithms whose predictions can be explained, exact
+// contributions for linear models and tree path contributions for ensembles
+var explainable = map[string]bool{
+	"LogisticRegression":         true,
+	"SGDClassifier":              true,
+	"RandomForestClassifier":     true,
+	"GradientBoostingClassifier": true,
+}
+
+// Explanation lists the input columns contributing most toward the predicted
+// class of a row. For linear and gradient boosting models the contributions are
+// in log odds, the decision function of the class is Bias plus the sum of the
+// contributions of every column. For random forests they are in probability,
+// Bias is close to the share of the class in the training data.
+type Explanation struct {
+	Class         string         `json:"class"`
+	Bias          float64        `json:"bias"`
+	Contributions []Contribution `json:"contributions"` // largest magnitude first
+}
+
+// Contribution is the total contribution of the features derived from an input
+// column toward the predicted class, negative values count against the class
+type Contribution struct {
+	Column       string  `json:"column"`
+	Contribution float64 `json:"contribution"`
+}
+
+// rawExplanation is an explanation returned by predict.py, the contributions
+// are by vectorized feature
+type rawExplanation struct {
+	Class    string             `json:"class"`
+	Bias     float64            `json:"bias"`
+	Features map[string]float64 `json:"features"`
+}
+
+type byContribution []Contribution
+
+func (c byContribution) Len() int      { return len(c) }
+func (c byContribution) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byContribution) Less(i, j int) bool {
+	a, b := math.Abs(c[i].Contribution), math.Abs(c[j].Contribution)
+	if a != b {
+		return a > b
+	}
+	return c[i].Column < c[j].Column
+}
+
+// explain sums the feature contributions of each explanation by input column,
+// keeping the top columns with the largest contributions
+func (s Schema) explain(raw []rawExplanation, top int) []Explanation {
+	if top <= 0 {
+		top = defaultExplainTop
+	}
+	types := s.featureTypes()
+
+	explanations := make([]Explanation, len(raw))
+	for i, r := range raw {
+		totals := make(map[string]float64)
+		for feature, c := range r.Features {
+			totals[s.inputColumn(feature, types)] += c
+		}
+
+		contributions := make([]Contribution, 0, len(totals))
+		for col, c := range totals {
+			contributions = append(contributions, Contribution{col, c})
+		}
+		sort.Sort(byContribution(contributions))
+		if len(contributions) > top {
+			contributions = contributions[:top]
+		}
+
+		explanations[i] = Explanation{r.Class, r.Bias, contributions}
+	}
+	return explanations
+}
+
+// inputColumn returns the input column a vectorized feature was derived from.
+// One-hot encoded values and text terms are named <column>=<value>, column
+// names may hold = as well, so the feature is split at the first = giving a
+// known column. Datetime features are mapped to the datetime column.
+func (s Schema) inputColumn(feature string, types map[string]string) string {
+	col := feature
+	if _, ok := types[feature]; !ok {
+		for i := 0; i < len(feature); i++ {
+			if feature[i] != '=' {
+				continue
+			}
+			if _, ok := types[feature[:i]]; ok {
+				col = feature[:i]
+				break
+			}
+		}
+	}
+	return s.sourceColumn(col)
+}
+
+// explainFromForm reads the explain and explain_top fields of a predict
+// request, fields that are not present leave d unchanged
+func explainFromForm(form map[string][]string, d *ModelReq) error {
+	if val := formValue(form, "explain"); val != "" {
+		explain, err := strconv.ParseBool(strings.TrimSpace(val))
+		if err != nil {
+			return errors.New("mlserver: explain should be true or false")
+		}
+		d.Explain = explain
+	}
+	if val := formValue(form, "explain_top"); val != "" {
+		top, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			return errors.New("mlserver: explain_top should be a whole number")
+		}
+		d.ExplainTop = top
+	}
+	return nil
+}
+
+// checkExplain returns an error if explanations are requested for a model
+// that can't explain its predictions
+func checkExplain(d ModelReq, algorithm string) error {
+	if !d.Explain {
+		return nil
+	}
+	if !explainable[algorithm] {
+		return fmt.Errorf("mlserver: predictions of %s models can't be explained", algorithm)
+	}
+	if d.ExplainTop < 0 {
+		return errors.New("mlserver: explain_top should not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// Importances are the global feature importances of a fitted model. Method is
+// how they were computed: "tree" for the importances of tree ensembles,
+// "coefficients" for the mean absolute coefficient of linear models, or
+// "permutation" for the drop in accuracy when a column's values are shuffled.
+// Features holds the importance of each feature seen by the model, one-hot
+// encoded values and text terms are separate features, Columns sums them by
+// input column. Both are sorted by importance, highest first.
+type Importances struct {
+	Method   string              `json:"method"`
+	Features []FeatureImportance `json:"features"`
+	Columns  []ColumnImportance  `json:"columns"`
+}
+
+// FeatureImportance is the importance of a single feature seen by the model,
+// Column is the input column the feature was derived from
+type FeatureImportance struct {
+	Feature    string  `json:"feature"`
+	Column     string  `json:"column"`
+	Importance float64 `json:"importance"`
+}
+
+// ColumnImportance is the total importance of the features derived from an
+// input column
+type ColumnImportance struct {
+	Column     string  `json:"column"`
+	Importance float64 `json:"importance"`
+}
+
+type byImportance []ColumnImportance
+
+func (c byImportance) Len() int      { return len(c) }
+func (c byImportance) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byImportance) Less(i, j int) bool {
+	if c[i].Importance != c[j].Importance {
+		return c[i].Importance > c[j].Importance
+	}
+	return c[i].Column < c[j].Column
+}
+
+// Features returns the feature importances of the model. The importances of
+// each feature are saved by fit.py in <model_id>.features.json, the features
+// derived from a datetime column are attributed to that column and the
+// importances are summed by column. An error satisfying os.IsNotExist is
+// returned for models fit without feature importances.
+func (m *Model) Features() (Importances, error) {
+	var imp Importances
+	err := readJSONFile(filepath.Join(m.dir, m.ID+".features.json"), &imp)
+	if err != nil {
+		return Importances{}, err
+	}
+
+	totals := make(map[string]float64)
+	for i, f := range imp.Features {
+		col := m.Schema.sourceColumn(f.Column)
+		imp.Features[i].Column = col
+		totals[col] += f.Importance
+	}
+
+	imp.Columns = make([]ColumnImportance, 0, len(totals))
+	for col, total := range totals {
+		imp.Columns = append(imp.Columns, ColumnImportance{col, total})
+	}
+	sort.Sort(byImportance(imp.Columns))
+
+	return imp, nil
+}
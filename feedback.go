@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// calibrationBins is the number of equal width confidence bins of LiveMetrics
+const calibrationBins = 10
+
+// ServedPrediction is a row of a predict request along with its prediction,
+// every predicted row is appended to the saved predictions of the model so
+// feedback can be joined to it later. Data holds the row as received, without
+// the columns redacted from the prediction log, see redactColumns.
+type ServedPrediction struct {
+	ID     string                 `json:"prediction_id"`
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data"`
+	Labels map[string]float64     `json:"labels"`
+}
+
+// Feedback is the true label of a predicted row
+type Feedback struct {
+	PredictionID string      `json:"prediction_id"`
+	Label        interface{} `json:"label"`
+}
+
+// FeedbackRecord is a prediction joined with its feedback, records are
+// appended to <model_id>.feedback.jsonl. A prediction given feedback more than
+// once has a record for each, the newest one counts.
+type FeedbackRecord struct {
+	ServedPrediction
+	Label      interface{} `json:"label"`
+	FeedbackAt time.Time   `json:"feedback_at"`
+}
+
+// LiveMetrics compare the predictions of a model to the labels received as
+// feedback, over the newest rows with feedback. Calibration holds the accuracy
+// of the predictions by the probability of the predicted label.
+type LiveMetrics struct {
+	Rows            int                           `json:"rows"`
+	Updated         time.Time                     `json:"updated_at"`
+	ConfusionMatrix map[string]map[string]float64 `json:"confusion_matrix"`
+	Metrics         Metrics                       `json:"metrics"`
+	Calibration     []CalibrationBin              `json:"calibration"`
+}
+
+// CalibrationBin holds the predictions whose most likely label has a
+// probability from Lower up to Upper, for a well calibrated model Confidence,
+// the mean probability, is close to Accuracy
+type CalibrationBin struct {
+	Lower      float64 `json:"lower"`
+	Upper      float64 `json:"upper"`
+	Rows       int     `json:"rows"`
+	Confidence float64 `json:"confidence"`
+	Accuracy   float64 `json:"accuracy"`
+}
+
+// newPredictionID returns an id for a row saved in a segment of the saved
+// predictions, <model_id>.<segment>.<uuid>, prefixed with the model id so
+// feedback can be routed to the model
+func newPredictionID(modelID string, segment int) string {
+	return modelID + "." + strconv.Itoa(segment) + "." + uuid.New()
+}
+
+// predictionModelID returns the id of the model that made a prediction, the
+// empty string is returned for malformed ids. The model id names the model
+// directory, so only ids whose model id is a UUID and whose segment is a number
+// are accepted.
+func predictionModelID(predictionID string) string {
+	if _, ok := predictionSegment(predictionID); !ok {
+		return ""
+	}
+	id := predictionID[:strings.Index(predictionID, ".")]
+	if u := uuid.Parse(id); u == nil || u.String() != id {
+		return ""
+	}
+	return id
+}
+
+// predictionSegment returns the segment of the saved predictions holding a
+// prediction, false is returned for malformed ids
+func predictionSegment(predictionID string) (int, bool) {
+	parts := strings.SplitN(predictionID, ".", 3)
+	if len(parts) != 3 {
+		return 0, false
+	}
+	segment, err := strconv.Atoi(parts[1])
+	return segment, err == nil && segment > 0
+}
+
+// ParseFeedback decodes a JSON encoded feedback request:
+//
+//		{
+//			"feedback": [
+//				{"prediction_id": "0e12bb73-...", "label": "setosa"},
+//				...
+//			]
+//		}
+func ParseFeedback(r io.Reader) ([]Feedback, error) {
+	var req struct {
+		Feedback []Feedback `json:"feedback"`
+	}
+	err := json.NewDecoder(r).Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Feedback) == 0 {
+		return nil, errors.New("mlserver: feedback should hold at least one label")
+	}
+	for i, fb := range req.Feedback {
+		if fb.PredictionID == "" {
+			return nil, fmt.Errorf("mlserver: feedback %d is missing prediction_id", i)
+		}
+		if fb.Label == nil || fb.Label == "" {
+			return nil, fmt.Errorf("mlserver: feedback for %s is missing label", fb.PredictionID)
+		}
+	}
+	return req.Feedback, nil
+}
+
+// savePredictions assigns an id to each predicted row and appends the rows to
+// the current segment of the saved predictions, input holds the rows as
+// received. A full segment, holding -saved-predictions-max-size bytes, is
+// rotated before rows are appended, only the newest -saved-predictions-max-files
+// segments are kept.
+func (m *Model) savePredictions(pred *Prediction, input []map[string]interface{}, t time.Time) error {
+	redact := redactColumns()
+
+	m.predictionsLock.Lock()
+	defer m.predictionsLock.Unlock()
+
+	err := m.openSegments()
+	if err != nil {
+		return err
+	}
+	if m.segmentSize >= *savedPredictionsSize {
+		err = m.rotateSegment()
+		if err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	pred.IDs = make([]string, len(pred.Labels))
+	for i, labels := range pred.Labels {
+		pred.IDs[i] = newPredictionID(m.ID, m.segment)
+		p := ServedPrediction{ID: pred.IDs[i], Time: t, Labels: labels}
+		if i < len(input) {
+			p.Data = withoutColumns(input[i], redact)
+		}
+		err = enc.Encode(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(m.segmentPath(m.segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(buf.Bytes())
+	if err == nil {
+		m.segmentSize += int64(n)
+	} else if n > 0 {
+		f.Truncate(m.segmentSize) // drop the partially written rows
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		m.unsynced = true
+	}
+	return err
+}
+
+// withoutColumns returns a copy of row without the columns in drop
+func withoutColumns(row map[string]interface{}, drop map[string]bool) map[string]interface{} {
+	if len(drop) == 0 || row == nil {
+		return row
+	}
+	kept := make(map[string]interface{}, len(row))
+	for col, val := range row {
+		if !drop[col] {
+			kept[col] = val
+		}
+	}
+	return kept
+}
+
+// openSegments finds the newest segment of the saved predictions and its size
+// the first time rows are saved, m.predictionsLock should be held. Segments
+// are only fetched from storage when feedback needs them, a new segment is
+// started when the newest stored segment isn't in the model directory.
+func (m *Model) openSegments() error {
+	if m.segment > 0 {
+		return nil
+	}
+	local, err := m.predictionSegments()
+	if err != nil {
+		return err
+	}
+	stored, err := m.storedSegments()
+	if err != nil {
+		return err
+	}
+
+	m.segment, m.segmentSize = 1, 0
+	switch {
+	case len(stored) > 0 && (len(local) == 0 || stored[len(stored)-1] > local[len(local)-1]):
+		m.segment = stored[len(stored)-1] + 1
+	case len(local) > 0:
+		m.segment = local[len(local)-1]
+		info, err := os.Stat(m.segmentPath(m.segment))
+		if err == nil {
+			m.segmentSize = info.Size()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		// rows saved before a restart may not have been stored
+		m.unsynced = m.segmentSize > 0
+	}
+	m.synced = m.segment - 1
+	return nil
+}
+
+// rotateSegment starts a new segment and removes the segments beyond
+// -saved-predictions-max-files, m.predictionsLock should be held
+func (m *Model) rotateSegment() error {
+	m.segment++
+	m.segmentSize = 0
+
+	segments, err := m.predictionSegments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment > m.segment-*savedPredictionsFiles {
+			break
+		}
+		err = os.Remove(m.segmentPath(segment))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// predictionSegments returns the segments of the saved predictions in the
+// model directory, oldest first
+func (m *Model) predictionSegments() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(m.dir, m.ID+".predictions.*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, path := range paths {
+		if segment, ok := segmentNumber(m.ID, filepath.Base(path)); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// storedSegments returns the segments of the saved predictions in storage,
+// oldest first
+func (m *Model) storedSegments() ([]int, error) {
+	if m.store == nil {
+		return nil, nil
+	}
+	names, err := m.store.Artifacts(m.ID)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, name := range names {
+		if segment, ok := segmentNumber(m.ID, name); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// segmentNumber returns the segment of the saved predictions of model id named
+// <model_id>.predictions.<segment>.jsonl, false is returned for other names
+func segmentNumber(id, name string) (int, bool) {
+	prefix := id + ".predictions."
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".jsonl") {
+		return 0, false
+	}
+	segment, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".jsonl"))
+	return segment, err == nil && segment > 0
+}
+
+// AddFeedback joins the labels to the saved predictions of the model, appends
+// the joined records to <model_id>.feedback.jsonl, and updates the live
+// metrics from the feedback window. Only the segments holding the predictions are read, fetched from
+// storage when they aren't in the model directory, without blocking predict
+// requests. The ids of feedback without a matching
+// prediction, including predictions in segments that were removed, are
+// returned.
+func (m *Model) AddFeedback(feedback []Feedback) ([]string, error) {
+	bySegment := make(map[int]map[string]interface{})
+	for _, fb := range feedback {
+		segment, ok := predictionSegment(fb.PredictionID)
+		if !ok {
+			continue
+		}
+		if bySegment[segment] == nil {
+			bySegment[segment] = make(map[string]interface{})
+		}
+		bySegment[segment][fb.PredictionID] = fb.Label
+	}
+
+	// rows are only read up to the size of the current segment when the
+	// feedback arrived, rows appended later may be partially written
+	m.predictionsLock.Lock()
+	err := m.openSegments()
+	current, size := m.segment, m.segmentSize
+	m.predictionsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int, 0, len(bySegment))
+	for segment := range bySegment {
+		if segment <= current && segment > current-*savedPredictionsFiles {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+
+	now := time.Now().UTC()
+	var records []FeedbackRecord
+	found := make(map[string]bool, len(feedback))
+	for _, segment := range segments {
+		limit := int64(-1)
+		if segment == current {
+			limit = size
+		}
+		if segment < current {
+			err = m.fetch(filepath.Base(m.segmentPath(segment)))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		labels := bySegment[segment]
+		err = readPredictions(m.segmentPath(segment), limit, func(p ServedPrediction) {
+			if label, ok := labels[p.ID]; ok && !found[p.ID] {
+				records = append(records, FeedbackRecord{p, label, now})
+				found[p.ID] = true
+			}
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	unknown := []string{}
+	for _, fb := range feedback {
+		if !found[fb.PredictionID] {
+			unknown = append(unknown, fb.PredictionID)
+		}
+	}
+	if len(records) == 0 {
+		return unknown, nil
+	}
+
+	m.feedbackLock.Lock()
+	defer m.feedbackLock.Unlock()
+
+	f, err := os.OpenFile(m.feedbackPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	for _, rec := range records {
+		err = enc.Encode(rec)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	info, err := f.Stat()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = m.trimFeedback(info.Size())
+	}
+	if err == nil {
+		err = m.persist(filepath.Base(m.feedbackPath()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range records {
+		m.window.add(rec)
+	}
+	m.updateLive()
+	return unknown, nil
+}
+
+// trimFeedback rewrites <model_id>.feedback.jsonl once its size is over
+// -feedback-max-size bytes, keeping the newest records up to half the limit and
+// only the newest record of each prediction. m.feedbackLock should be held.
+func (m *Model) trimFeedback(size int64) error {
+	if size <= *feedbackMaxSize {
+		return nil
+	}
+	records, err := m.Feedback()
+	if err != nil {
+		return err
+	}
+
+	// records are kept from the newest back
+	lines := make([][]byte, len(records))
+	first, kept := len(records), int64(0)
+	for first > 0 {
+		line, err := json.Marshal(records[first-1])
+		if err != nil {
+			return err
+		}
+		if kept+int64(len(line))+1 > *feedbackMaxSize/2 {
+			break
+		}
+		first--
+		lines[first] = line
+		kept += int64(len(line)) + 1
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines[first:] {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	path := m.feedbackPath()
+	err = ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// readPredictions calls fn with each saved prediction in the segment at path,
+// only the first limit bytes are read unless limit is negative
+func readPredictions(path string, limit int64, fn func(ServedPrediction)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var p ServedPrediction
+		err = dec.Decode(&p)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(p)
+	}
+}
+
+// Feedback returns the feedback records of the model, oldest first, with only
+// the newest record of predictions given feedback more than once
+func (m *Model) Feedback() ([]FeedbackRecord, error) {
+	var records []FeedbackRecord
+	latest := make(map[string]int)
+	err := readJSONLines(m.feedbackPath(), func(dec *json.Decoder) error {
+		var rec FeedbackRecord
+		err := dec.Decode(&rec)
+		if err != nil {
+			return err
+		}
+		latest[rec.ID] = len(records)
+		records = append(records, rec)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return []FeedbackRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	newest := make([]FeedbackRecord, 0, len(latest))
+	for i, rec := range records {
+		if latest[rec.ID] == i {
+			newest = append(newest, rec)
+		}
+	}
+	return newest, nil
+}
+
+// feedbackWindow holds the newest -live-metrics-window feedback records, oldest
+// first, with only the newest record of each prediction
+type feedbackWindow struct {
+	records []FeedbackRecord
+	ids     map[string]bool
+}
+
+// add appends rec to the window, replacing an earlier record of the same
+// prediction and dropping the oldest record once the window is full
+func (w *feedbackWindow) add(rec FeedbackRecord) {
+	if w.ids == nil {
+		w.ids = make(map[string]bool)
+	}
+	if w.ids[rec.ID] {
+		for i := range w.records {
+			if w.records[i].ID == rec.ID {
+				w.records = append(w.records[:i], w.records[i+1:]...)
+				break
+			}
+		}
+	}
+	w.records = append(w.records, rec)
+	w.ids[rec.ID] = true
+	if len(w.records) > *liveMetricsWindow {
+		delete(w.ids, w.records[0].ID)
+		w.records = w.records[1:]
+	}
+}
+
+// loadFeedback fills the feedback window from <model_id>.feedback.jsonl and
+// computes the live metrics, only the window is kept in memory
+func (m *Model) loadFeedback() error {
+	m.feedbackLock.Lock()
+	defer m.feedbackLock.Unlock()
+
+	m.window = feedbackWindow{}
+	err := readJSONLines(m.feedbackPath(), func(dec *json.Decoder) error {
+		var rec FeedbackRecord
+		err := dec.Decode(&rec)
+		if err == nil {
+			m.window.add(rec)
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.updateLive()
+	return nil
+}
+
+// updateLive replaces the live metrics with those of the feedback window,
+// m.feedbackLock should be held
+func (m *Model) updateLive() {
+	live := liveMetrics(m.window.records)
+	m.liveLock.Lock()
+	m.Performance.Live = live
+	m.liveLock.Unlock()
+}
+
+// liveMetrics computes the live metrics from feedback records, nil is returned
+// when there are none
+func liveMetrics(records []FeedbackRecord) *LiveMetrics {
+	if len(records) == 0 {
+		return nil
+	}
+
+	labels := make([]interface{}, len(records))
+	probs := make([]map[string]float64, len(records))
+	for i, rec := range records {
+		labels[i], probs[i] = rec.Label, rec.Labels
+	}
+
+	live := &LiveMetrics{Rows: len(records), Updated: records[len(records)-1].FeedbackAt}
+	live.ConfusionMatrix, live.Metrics = evaluate(labels, probs)
+	live.Calibration = calibration(labels, probs)
+	return live
+}
+
+// calibration bins the predictions by the probability of the most likely label,
+// numeric labels are matched to the predicted labels by value
+func calibration(labels []interface{}, probs []map[string]float64) []CalibrationBin {
+	bins := make([]CalibrationBin, calibrationBins)
+	for i := range bins {
+		bins[i].Lower, bins[i].Upper = float64(i)/calibrationBins, float64(i+1)/calibrationBins
+	}
+
+	for i, p := range probs {
+		predicted := mostLikely(p)
+		b := int(math.Min(p[predicted]*calibrationBins, calibrationBins-1))
+		bins[b].Rows++
+		bins[b].Confidence += p[predicted]
+		if normalizeLabel(categoricalValue(labels[i])) == normalizeLabel(predicted) {
+			bins[b].Accuracy++
+		}
+	}
+	for i := range bins {
+		if bins[i].Rows > 0 {
+			bins[i].Confidence /= float64(bins[i].Rows)
+			bins[i].Accuracy /= float64(bins[i].Rows)
+		}
+	}
+	return bins
+}
+
+// segmentPath returns the path of a segment of the saved predictions
+func (m *Model) segmentPath(segment int) string {
+	return filepath.Join(m.dir, m.ID+".predictions."+strconv.Itoa(segment)+".jsonl")
+}
+
+func (m *Model) feedbackPath() string {
+	return filepath.Join(m.dir, m.ID+".feedback.jsonl")
+}
+
+// readJSONLines opens the file at path and calls fn until it returns io.EOF,
+// fn should decode a single value with the decoder
+func readJSONLines(path string, fn func(dec *json.Decoder) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		err = fn(dec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
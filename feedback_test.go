@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestPredictionModelID(t *testing.T) {
+	modelID := "0e12bb73-e49a-4dcd-87aa-cb0338b1c758"
+	tests := []struct {
+		predictionID string
+		modelID      string
+	}{
+		{modelID + ".1.4f0c7a1e-9b1d-4c4e-8f2a-3e5d6c7b8a90", modelID},
+		{modelID + ".12.x", modelID},
+		{modelID + ".0.x", ""},
+		{modelID + ".one.x", ""},
+		{modelID + ".1", ""},
+		{"0E12BB73-E49A-4DCD-87AA-CB0338B1C758.1.x", ""},
+		{"urn:uuid:" + modelID + ".1.x", ""},
+		{"../" + modelID + ".1.x", ""},
+		{"...1.x", ""},
+		{"..", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if id := predictionModelID(tt.predictionID); id != tt.modelID {
+			t.Errorf("predictionModelID(%q) = %q, want %q", tt.predictionID, id, tt.modelID)
+		}
+	}
+}
+
+func TestFeedbackWindow(t *testing.T) {
+	size := *liveMetricsWindow
+	*liveMetricsWindow = 3
+	defer func() { *liveMetricsWindow = size }()
+
+	var w feedbackWindow
+	for _, id := range []string{"a", "b", "a", "c", "d"} {
+		w.add(FeedbackRecord{ServedPrediction: ServedPrediction{ID: id}})
+	}
+
+	var ids []string
+	for _, rec := range w.records {
+		ids = append(ids, rec.ID)
+	}
+	if want := []string{"a", "c", "d"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("window holds %v, want %v", ids, want)
+	}
+	if len(w.ids) != 3 || w.ids["b"] {
+		t.Errorf("window ids %v, want a, c, and d", w.ids)
+	}
+}
+
+func TestAddFeedback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mlserver-feedback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Model{ID: uuid.New(), dir: dir}
+	pred := Prediction{Labels: []map[string]float64{
+		{"a": 0.9, "b": 0.1},
+		{"a": 0.2, "b": 0.8},
+		{"a": 0.6, "b": 0.4},
+	}}
+	err = m.savePredictions(&pred, nil, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := m.ID + ".1." + uuid.New()
+	unknown, err := m.AddFeedback([]Feedback{
+		{pred.IDs[0], "a"},
+		{pred.IDs[1], "a"},
+		{bad, "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unknown, []string{bad}) {
+		t.Errorf("unknown %v, want %v", unknown, []string{bad})
+	}
+	live := m.Performance.Live
+	if live == nil || live.Rows != 2 || live.Metrics.Accuracy != 0.5 {
+		t.Fatalf("live metrics %+v, want 2 rows with accuracy 0.5", live)
+	}
+
+	// a new label for a prediction replaces the earlier one
+	_, err = m.AddFeedback([]Feedback{{pred.IDs[1], "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live := m.Performance.Live; live.Rows != 2 || live.Metrics.Accuracy != 1 {
+		t.Errorf("live metrics %+v, want 2 rows with accuracy 1", live)
+	}
+
+	loaded := &Model{ID: m.ID, dir: dir}
+	err = loaded.loadFeedback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Performance.Live, m.Performance.Live) {
+		t.Errorf("loaded live metrics %+v, want %+v", loaded.Performance.Live, m.Performance.Live)
+	}
+}
+
+func TestTrimFeedback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mlserver-feedback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Model{ID: uuid.New(), dir: dir}
+	pred := Prediction{Labels: make([]map[string]float64, 20)}
+	for i := range pred.Labels {
+		pred.Labels[i] = map[string]float64{"a": 0.5, "b": 0.5}
+	}
+	err = m.savePredictions(&pred, nil, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxSize := *feedbackMaxSize
+	*feedbackMaxSize = 2000
+	defer func() { *feedbackMaxSize = maxSize }()
+
+	for _, id := range pred.IDs {
+		_, err = m.AddFeedback([]Feedback{{id, "a"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(m.feedbackPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > *feedbackMaxSize {
+			t.Fatalf("feedback file is %d bytes, want at most %d", info.Size(), *feedbackMaxSize)
+		}
+	}
+
+	records, err := m.Feedback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || len(records) == len(pred.IDs) {
+		t.Fatalf("%d records kept of %d", len(records), len(pred.IDs))
+	}
+	if newest := records[len(records)-1].ID; newest != pred.IDs[len(pred.IDs)-1] {
+		t.Errorf("newest record %s, want %s", newest, pred.IDs[len(pred.IDs)-1])
+	}
+	if rows := m.Performance.Live.Rows; rows != len(pred.IDs) {
+		t.Errorf("live metrics over %d rows, want %d", rows, len(pred.IDs))
+	}
+}
@@ -2,44 +2,155 @@ package main
 
 var fitPy = `
 import os
+import csv
 import json
 import datetime
+import functools
+import time
+
+import numpy
+import scipy.stats
 
 from sklearn.ensemble import RandomForestClassifier, GradientBoostingClassifier
-from sklearn.linear_model import LogisticRegression
+from sklearn.linear_model import LogisticRegression, SGDClassifier
+from sklearn.naive_bayes import BernoulliNB
 from sklearn.feature_extraction import DictVectorizer
 from sklearn.pipeline import Pipeline
 from sklearn.externals import joblib
-from sklearn.cross_validation import cross_val_score
-from sklearn.metrics import confusion_matrix
-
-def fit(X, Y):
-  models = {
-    'LogisticRegression': LogisticRegression(),
-    'GradientBoostingClassifier': GradientBoostingClassifier(n_estimators=150),
-    'RandomForestClassifier': RandomForestClassifier(n_estimators=150)
-  }
-
-  best_score = 0
-  best_model = ''
-  for model in models:
-    vec = DictVectorizer(sparse=False)
-    clf = models[model]
-    pl = Pipeline([('vec', vec), ('clf', clf)])
-
-    #TODO: grid search for model params
-    scores = cross_val_score(pl, X, Y, n_jobs=3)
-    if scores.mean() > best_score:
-      best_score = scores.mean()
-      best_model = model
+from sklearn.externals.joblib import Parallel, delayed
+from sklearn.base import clone
+from sklearn.cross_validation import StratifiedKFold
+from sklearn.grid_search import ParameterGrid, ParameterSampler
+from sklearn.metrics import confusion_matrix, accuracy_score, recall_score, f1_score, roc_auc_score, log_loss, precision_recall_fscore_support
+
+ESTIMATORS = {
+  'LogisticRegression': LogisticRegression,
+  'SGDClassifier': SGDClassifier,
+  'BernoulliNB': BernoulliNB,
+  'RandomForestClassifier': RandomForestClassifier,
+  'GradientBoostingClassifier': GradientBoostingClassifier
+}
+
+def param_values(spec):
+  """the values to search for a parameter, either a list or a distribution
+  sampled by a random search"""
+  if not isinstance(spec, dict):
+    return spec
+  low, high = spec['low'], spec['high']
+  if spec['distribution'] == 'uniform':
+    return scipy.stats.uniform(low, high - low)
+  if spec['distribution'] == 'loguniform':
+    return scipy.stats.reciprocal(low, high)
+  return scipy.stats.randint(int(low), int(high) + 1)
+
+def json_value(val):
+  """convert numpy scalars to python values for json"""
+  return val.item() if hasattr(val, 'item') else val
+
+def candidates(alg, search):
+  """the parameter settings to try for an algorithm, every combination for a
+  grid search or a sample for a random search"""
+  params = {name: param_values(spec) for name, spec in (alg.get('params') or {}).items()}
+  if search['strategy'] != 'random' or not params:
+    return list(ParameterGrid(params))
+
+  n_iter = search['iterations']
+  if all(isinstance(vals, list) for vals in params.values()):
+    # sampling from a grid smaller than n_iter is an error
+    n_iter = min(n_iter, functools.reduce(lambda n, vals: n * len(vals), params.values(), 1))
+  return list(ParameterSampler(params, n_iter))
+
+LOWER_IS_BETTER = ('log_loss',)
+
+def score(metric, est, X, Y):
+  """score a fitted pipeline on X, Y with the named metric, the metrics are
+  checked by mlserver before fit.py is started"""
+  if metric == 'roc_auc':
+    return roc_auc_score([y == est.classes_[1] for y in Y], est.predict_proba(X)[:, 1])
+  if metric == 'log_loss':
+    return log_loss(Y, est.predict_proba(X))
+
+  Y_hat = est.predict(X)
+  if metric == 'balanced_accuracy':
+    return recall_score(Y, Y_hat, average='macro')
+  if metric == 'f1_macro':
+    return f1_score(Y, Y_hat, average='macro')
+  if metric == 'f1_weighted':
+    return f1_score(Y, Y_hat, average='weighted')
+  return accuracy_score(Y, Y_hat)
+
+def clf_params(pl, params):
+  """the pipeline parameters setting the estimator's parameters, None stands
+  for the sklearn default, the value in the unfitted pipeline"""
+  defaults = pl.get_params()
+  return {'clf__' + name: defaults['clf__' + name] if val is None else val for name, val in params.items()}
+
+def fit_fold(pl, params, metric, X, Y, train, test):
+  """fit a candidate on the train rows, returning the score on the test rows,
+  the time taken to fit in seconds, and the predicted probabilities for the
+  test rows along with the order of their columns"""
+  est = clone(pl).set_params(**clf_params(pl, params))
+  start = time.time()
+  est.fit([X[i] for i in train], [Y[i] for i in train])
+  elapsed = time.time() - start
+  X_test = [X[i] for i in test]
+  return score(metric, est, X_test, [Y[i] for i in test]), elapsed, est.predict_proba(X_test), est.classes_
+
+def fit(X, Y, search, sparse=False, text_columns=None, max_features=None):
+  """cross validate every parameter setting of each candidate algorithm, the
+  candidate with the best mean score for the search's scoring metric is refit
+  on all of the data. Returns the fitted pipeline, the leaderboard of all
+  candidates, best first, and the out-of-fold predicted probabilities of the
+  best candidate, one column per class in sorted order. Sparse data is kept
+  sparse, text columns are vectorized by TF-IDF and are always sparse."""
+  def pipeline(name):
+    if text_columns:
+      vec = ColumnVectorizer(text_columns, max_features)
+    else:
+      vec = DictVectorizer(sparse=sparse)
+    return Pipeline([('vec', vec), ('clf', ESTIMATORS[name]())])
+
+  lower_is_better = search['scoring'] in LOWER_IS_BETTER
+  classes = numpy.unique(Y)
+  column = {label: i for i, label in enumerate(classes)}
+  folds = list(StratifiedKFold(Y, n_folds=search['folds']))
+
+  leaderboard = []
+  oof = None  # out-of-fold probabilities of the best candidate so far
+  for alg in search['algorithms']:
+    pl = pipeline(alg['name'])
+    for params in candidates(alg, search):
+      results = Parallel(n_jobs=3)(delayed(fit_fold)(pl, params, search['scoring'], X, Y, train, test) for train, test in folds)
+      scores = [float(r[0]) for r in results]
+      mean_score = float(numpy.mean(scores))
+      leaderboard.append({
+        'algorithm': alg['name'],
+        'params': {name: json_value(val) for name, val in params.items()},
+        'scores': scores,
+        'mean_score': mean_score,
+        'std_score': float(numpy.std(scores)),
+        'fit_time': sum(r[1] for r in results) / len(results)
+      })
+
+      if oof is None or (mean_score < oof_score if lower_is_better else mean_score > oof_score):
+        oof, oof_score = numpy.zeros((len(Y), len(classes))), mean_score
+        for (train, test), (_, _, proba, fold_classes) in zip(folds, results):
+          for j, label in enumerate(fold_classes):
+            oof[test, column[label]] = proba[:, j]
+
+  # stable sort, ties keep the order the candidates were tried in
+  leaderboard.sort(key=lambda c: c['mean_score'], reverse=not lower_is_better)
+  for rank, c in enumerate(leaderboard):
+    c['rank'] = rank + 1
 
   # retrain best model with all data
-  vec = DictVectorizer(sparse=False)
-  clf = models[best_model]
-  pl = Pipeline([('vec', vec), ('clf', clf)])
+  best = leaderboard[0]
+  pl = pipeline(best['algorithm'])
+  pl.set_params(**clf_params(pl, best['params']))
   pl.fit(X, Y)
-  pl.score_ = best_score  # report cv score
-  return pl
+  pl.score_ = best['mean_score']  # report cv score
+  pl.params_ = best['params']
+  return pl, leaderboard, oof
 
 def save(path, model_id, model):
 	fname = model_id + '.pkl'
@@ -47,40 +158,194 @@ def save(path, model_id, model):
 		os.makedirs(path)
 	joblib.dump(model, os.path.join(path, fname))
 
-def save_metadata(path, model_id, model_name, model, X, Y):
-	Y_hat = model.predict(X)
-
-	labels = [l for l in model.named_steps['clf'].classes_]
+def save_leaderboard(path, model_id, leaderboard):
+	json.dump(leaderboard, open(os.path.join(path, model_id + '.leaderboard.json'), 'w'))
 
+def confusion_dict(Y, Y_hat, labels):
 	cm = confusion_matrix(Y, Y_hat, labels=labels)
 	# this is an insane dict comprehension, need to encode the val as a float, json will not encode 0
-	cm_dict = {str(labels[inx]): {str(labels[c]):float(val) for c, val in enumerate(row)} for inx, row in enumerate(cm)}
+	return {str(labels[inx]): {str(labels[c]):float(val) for c, val in enumerate(row)} for inx, row in enumerate(cm)}
+
+def class_metrics(precision, recall, f1, support):
+	return {"precision": float(precision), "recall": float(recall), "f1": float(f1), "support": int(support)}
+
+def evaluate(Y, proba, labels):
+	"""classification metrics for predicted probabilities, one column per label,
+	roc_auc is the mean of the one vs rest AUC of each class"""
+	Y_hat = [labels[i] for i in proba.argmax(axis=1)]
+	precision, recall, f1, support = precision_recall_fscore_support(Y, Y_hat, labels=labels)
+	weights = support / float(support.sum())
+
+	aucs = []
+	for i, label in enumerate(labels):
+		truth = [y == label for y in Y]
+		if 0 < sum(truth) < len(truth):
+			aucs.append(roc_auc_score(truth, proba[:, i]))
+
+	try:
+		loss = float(log_loss(Y, proba))
+	except ValueError:
+		loss = None
+
+	return {
+		"accuracy": float(accuracy_score(Y, Y_hat)),
+		"classes": {str(label): class_metrics(precision[i], recall[i], f1[i], support[i]) for i, label in enumerate(labels)},
+		"macro_avg": class_metrics(precision.mean(), recall.mean(), f1.mean(), support.sum()),
+		"weighted_avg": class_metrics((precision * weights).sum(), (recall * weights).sum(), (f1 * weights).sum(), support.sum()),
+		"roc_auc": float(numpy.mean(aucs)) if aucs else None,
+		"log_loss": loss
+	}, Y_hat
+
+def save_metadata(path, model_id, model_name, metric, model, X, Y, oof):
+	"""save the model metadata and performance, the metrics and confusion matrix
+	are computed from the out-of-fold predictions, the confusion matrix of the
+	predictions on the training data is kept as training_confusion_matrix"""
+	labels = [l for l in model.named_steps['clf'].classes_]
+
+	metrics, Y_oof = evaluate(Y, oof, labels)
+
+	vec = model.named_steps['vec']
+	vocabulary = vec.vocabulary_sizes() if hasattr(vec, 'vocabulary_sizes') else {}
 
 	model_data = {
 		"model_id": model_id,
 		"metadata": {
 			"name": model_name,
-			"created_at": datetime.datetime.utcnow().isoformat('T') + 'Z'
+			"created_at": datetime.datetime.utcnow().isoformat('T') + 'Z',
+			"vocabulary": vocabulary
 		},
 		"performance" : {
 			"algorithm": model.named_steps['clf'].__class__.__name__,
+			"params": model.params_,
 			"score": model.score_,
-			"confusion_matrix": cm_dict
+			"metric": metric,
+			"confusion_matrix": confusion_dict(Y, Y_oof, labels),
+			"training_confusion_matrix": confusion_dict(Y, model.predict(X), labels),
+			"metrics": metrics
 		}
 	}
 
 	json.dump(model_data, open(os.path.join(path, model_id + '.json'), 'w'))
 
 
+def input_column(feature, columns):
+	"""the input column of a vectorized feature, one-hot and text features are
+	named <column>=<value>, column names may hold = as well"""
+	if feature in columns:
+		return feature
+	i = feature.find('=')
+	while i >= 0:
+		if feature[:i] in columns:
+			return feature[:i]
+		i = feature.find('=', i + 1)
+	return feature
+
+# permutation importance is estimated on a sample of the rows, for at most
+# this many of the most common input columns
+PERMUTATION_ROWS = 1000
+PERMUTATION_COLUMNS = 100
+
+def permutation_importance(model, X, Y):
+	"""the drop in accuracy when the values of each input column are shuffled
+	between rows"""
+	rng = numpy.random.RandomState(0)
+	rows = rng.permutation(len(X))[:PERMUTATION_ROWS]
+	X, Y = [X[i] for i in rows], [Y[i] for i in rows]
+	baseline = accuracy_score(Y, model.predict(X))
+
+	counts = {}
+	for x in X:
+		for col in x:
+			counts[col] = counts.get(col, 0) + 1
+	columns = sorted(counts, key=lambda col: (-counts[col], col))[:PERMUTATION_COLUMNS]
+
+	importances = {}
+	for col in columns:
+		values = [x.get(col) for x in X]
+		rng.shuffle(values)
+		X_perm = []
+		for x, val in zip(X, values):
+			x = {k: v for k, v in x.items() if k != col}
+			if val is not None:
+				x[col] = val
+			X_perm.append(x)
+		importances[col] = baseline - accuracy_score(Y, model.predict(X_perm))
+	return importances
+
+def feature_importances(model, X, Y, types):
+	"""global feature importances of the fitted pipeline along with the method
+	used: the importances of tree ensembles, the mean absolute coefficient over
+	classes for linear models, otherwise permutation importance of the input
+	columns. Each feature is mapped to its input column."""
+	clf = model.named_steps['clf']
+	if hasattr(clf, 'feature_importances_') or hasattr(clf, 'coef_'):
+		names = model.named_steps['vec'].get_feature_names()
+		if hasattr(clf, 'feature_importances_'):
+			method, values = 'tree', clf.feature_importances_
+		else:
+			method, values = 'coefficients', numpy.abs(clf.coef_).mean(axis=0)
+		importances = dict(zip(names, values))
+	else:
+		method, importances = 'permutation', permutation_importance(model, X, Y)
+
+	features = [{"feature": name, "column": input_column(name, types), "importance": float(val)} for name, val in importances.items()]
+	features.sort(key=lambda f: (-f['importance'], f['feature']))
+	return {"method": method, "features": features}
+
+def save_features(path, model_id, model, X, Y, types):
+	json.dump(feature_importances(model, X, Y, types), open(os.path.join(path, model_id + '.features.json'), 'w'))
+
+def load_data(manifest):
+	"""read the training csv written by mlserver, the first column holds the
+	labels, empty cells are missing values and are left out of the row"""
+	types = manifest['types']
+	numeric_labels = manifest['label_type'] == 'numeric'
+
+	X, Y = [], []
+	with open(manifest['data'], newline='') as f:
+		reader = csv.reader(f)
+		features = next(reader)[1:]
+		for row in reader:
+			Y.append(float(row[0]) if numeric_labels else row[0])
+			x = {}
+			for name, val in zip(features, row[1:]):
+				if val == '':
+					continue
+				x[name] = float(val) if types[name] == 'numeric' else val
+			X.append(x)
+	return X, Y
+
+def load_svmlight(manifest):
+	"""read the training data written by mlserver in svmlight format, each row
+	holds only the non-zero features"""
+	numeric_labels = manifest['label_type'] == 'numeric'
+
+	X, Y = [], []
+	with open(manifest['data']) as f:
+		for line in f:
+			fields = line.split()
+			Y.append(float(fields[0]) if numeric_labels else fields[0])
+			X.append({name: float(val) for name, val in (field.rsplit(':', 1) for field in fields[1:])})
+	return X, Y
+
+
 if __name__ == "__main__":
 	import sys
 
-	data = json.load(open(sys.argv[2]))
+	manifest = json.load(open(sys.argv[2]))
 	model_save_path = sys.argv[1]
 	model_id = os.path.basename(model_save_path)
 
-	model = fit(data['data'], data['labels'])
+	sparse = manifest['format'] == 'svmlight'
+	if sparse:
+		X, Y = load_svmlight(manifest)
+	else:
+		X, Y = load_data(manifest)
+	text_columns = sorted(name for name, typ in manifest['types'].items() if typ == 'text')
+	model, leaderboard, oof = fit(X, Y, manifest['search'], sparse, text_columns, manifest['max_features'] or None)
 	save(model_save_path, model_id, model)
-	save_metadata(model_save_path, model_id, data['name'], model, data['data'], data['labels'])
+	save_leaderboard(model_save_path, model_id, leaderboard)
+	save_features(model_save_path, model_id, model, X, Y, manifest['types'])
+	save_metadata(model_save_path, model_id, manifest['name'], manifest['search']['scoring'], model, X, Y, oof)
 
 `
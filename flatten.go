@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// array handling, see Flatten.Arrays
+const (
+	arraysMultiHot = "multi_hot"
+	arraysIndex    = "index"
+)
+
+// Flatten describes how nested objects and arrays in JSON rows are turned into
+// columns. Nested keys are joined into a path, {"user": {"age": 31}} becomes
+// the column user.age. Arrays of strings and numbers are either multi-hot
+// encoded, {"tags": ["a", "b"]} becomes tags.a = 1 and tags.b = 1, or indexed,
+// tags.0 = "a" and tags.1 = "b". Objects and arrays inside arrays are always
+// indexed. Nulls are missing values and are left out of the row.
+type Flatten struct {
+	// Separator joins the keys of nested values, defaults to "."
+	Separator string `json:"separator,omitempty"`
+	// Arrays is either "multi_hot" (the default) or "index"
+	Arrays string `json:"arrays,omitempty"`
+}
+
+// validate returns a description of each problem with the flatten options
+func (f Flatten) validate() []string {
+	var errs []string
+	if f.Arrays != "" && f.Arrays != arraysMultiHot && f.Arrays != arraysIndex {
+		errs = append(errs, fmt.Sprintf("unknown array flattening %q", f.Arrays))
+	}
+	return errs
+}
+
+// apply flattens the nested values of row in place, the names of columns holding
+// multi-hot indicators are added to indicators when it is not nil
+func (f Flatten) apply(row map[string]interface{}, indicators map[string]bool) {
+	for key, val := range row {
+		switch val.(type) {
+		case nil:
+			delete(row, key)
+		case map[string]interface{}, []interface{}:
+			delete(row, key)
+			f.flatten(key, val, row, indicators)
+		}
+	}
+}
+
+func (f Flatten) flatten(path string, val interface{}, row map[string]interface{}, indicators map[string]bool) {
+	sep := f.Separator
+	if sep == "" {
+		sep = "."
+	}
+
+	switch v := val.(type) {
+	case nil:
+	case map[string]interface{}:
+		for key, elem := range v {
+			f.flatten(path+sep+key, elem, row, indicators)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			switch elem.(type) {
+			case nil:
+			case map[string]interface{}, []interface{}:
+				f.flatten(path+sep+strconv.Itoa(i), elem, row, indicators)
+			default:
+				if f.Arrays == arraysIndex {
+					row[path+sep+strconv.Itoa(i)] = elem
+					continue
+				}
+				col := path + sep + categoricalValue(elem)
+				row[col] = 1.0
+				if indicators != nil {
+					indicators[col] = true
+				}
+			}
+		}
+	default:
+		row[path] = val
+	}
+}
+
+// flattenFromForm reads the flatten options from the flatten_separator and
+// flatten_arrays form fields
+func flattenFromForm(form map[string][]string) Flatten {
+	return Flatten{
+		Separator: formValue(form, "flatten_separator"),
+		Arrays:    formValue(form, "flatten_arrays"),
+	}
+}
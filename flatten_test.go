@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	row := `{"id": 7, "user": {"age": 31, "city": {"name": "Boston"}, "phone": null},
+		"tags": ["a", "b", 3, null], "orders": [{"total": 9.5}, ["x"]], "note": null}`
+	tests := []struct {
+		flatten    Flatten
+		want       map[string]interface{}
+		indicators []string
+	}{
+		{
+			Flatten{},
+			map[string]interface{}{
+				"id": 7.0, "user.age": 31.0, "user.city.name": "Boston",
+				"tags.a": 1.0, "tags.b": 1.0, "tags.3": 1.0,
+				"orders.0.total": 9.5, "orders.1.x": 1.0,
+			},
+			[]string{"orders.1.x", "tags.3", "tags.a", "tags.b"},
+		},
+		{
+			Flatten{Separator: "_", Arrays: arraysIndex},
+			map[string]interface{}{
+				"id": 7.0, "user_age": 31.0, "user_city_name": "Boston",
+				"tags_0": "a", "tags_1": "b", "tags_2": 3.0,
+				"orders_0_total": 9.5, "orders_1_0": "x",
+			},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(row), &data); err != nil {
+			t.Fatal(err)
+		}
+		indicators := make(map[string]bool)
+		tt.flatten.apply(data, indicators)
+
+		if !reflect.DeepEqual(data, tt.want) {
+			t.Errorf("%+v: flattened %v, want %v", tt.flatten, data, tt.want)
+		}
+		var cols []string
+		for _, col := range []string{"orders.1.x", "tags.3", "tags.a", "tags.b"} {
+			if indicators[col] {
+				cols = append(cols, col)
+			}
+		}
+		if len(indicators) != len(tt.indicators) || !reflect.DeepEqual(cols, tt.indicators) {
+			t.Errorf("%+v: indicators %v, want %v", tt.flatten, indicators, tt.indicators)
+		}
+	}
+}
+
+func TestFlattenValidate(t *testing.T) {
+	for _, arrays := range []string{"", arraysMultiHot, arraysIndex} {
+		if errs := (Flatten{Arrays: arrays}).validate(); len(errs) != 0 {
+			t.Errorf("arrays %q: %v", arrays, errs)
+		}
+	}
+	if errs := (Flatten{Arrays: "explode"}).validate(); len(errs) != 1 {
+		t.Errorf("arrays \"explode\": %v, want an error", errs)
+	}
+}
+
+func TestFlattenProfile(t *testing.T) {
+	data := `{"label": "a", "user": {"age": 31}, "tags": ["x", "y"]}
+{"label": "b", "user": {"age": 40}, "tags": ["y"]}
+{"label": "a", "user": {}, "tags": []}
+`
+	ds, err := SpoolNDJSON(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Remove()
+	ds.Schema = Schema{Target: "label", Impute: "mean"}
+	err = ds.Profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"user.age": typeNumeric, "tags.x": typeNumeric, "tags.y": typeNumeric}
+	if !reflect.DeepEqual(ds.Schema.Types, want) {
+		t.Errorf("types %v, want %v", ds.Schema.Types, want)
+	}
+	// multi-hot indicators are absent rather than missing, so they're filled
+	// with zero whatever the imputation strategy
+	fill := map[string]interface{}{"user.age": 35.5, "tags.x": 0.0, "tags.y": 0.0}
+	if !reflect.DeepEqual(ds.Schema.Fill, fill) {
+		t.Errorf("fill %v, want %v", ds.Schema.Fill, fill)
+	}
+
+	var d ModelReq
+	err = json.Unmarshal([]byte(`{"data": [{"user": {"age": 20}, "tags": ["x", "z"]}]}`), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Schema.Apply(&d)
+	row := map[string]interface{}{"user.age": 20.0, "tags.x": 1.0, "tags.y": 0.0, "tags.z": 1.0}
+	if !reflect.DeepEqual(d.Data[0], row) {
+		t.Errorf("predict row %v, want %v", d.Data[0], row)
+	}
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"github.com/coreos/go-log/log"
 )
 
@@ -27,6 +35,186 @@ func notAllowed(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 }
 
+// modelError responds with 404 Not Found for ErrModelNotFound, otherwise with
+// the error message and 500 Internal Server Error
+func modelError(w http.ResponseWriter, err error) {
+	if err == ErrModelNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// badRequest responds with the error message and 400 Bad Request, or 413 Request
+// Entity Too Large if decompressing the request exceeded the size limit
+func badRequest(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if err == ErrTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// requestID returns the X-Request-ID header of the request, or a new id if the
+// header is not set
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Request-ID")); id != "" {
+		return id
+	}
+	return uuid.New()
+}
+
+//-----------------------------------------------------------------------------
+// Gzip Compression
+//-----------------------------------------------------------------------------
+
+// ErrTooLarge is returned when decompressed data exceeds the
+// max-decompressed-size limit
+var ErrTooLarge = errors.New("mlserver: decompressed data too large")
+
+// gzipHandler wraps an http.Handler, request bodies sent with Content-Encoding:
+// gzip are decompressed before being passed on, responses are compressed for
+// clients sending Accept-Encoding: gzip.
+func gzipHandler(fn http.Handler) http.Handler {
+	return gzipper{fn}
+}
+
+type gzipper struct {
+	h http.Handler
+}
+
+func (g gzipper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isGzip(r.Header.Get("Content-Encoding")) {
+		body, err := gunzip(r.Body)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(body)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+	}
+
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		g.h.ServeHTTP(w, r)
+		return
+	}
+
+	gw := &gzipResponseWriter{w: w}
+	defer gw.Close()
+	g.h.ServeHTTP(gw, r)
+}
+
+// gunzip returns a reader decompressing r, reads return ErrTooLarge once more
+// than max-decompressed-size bytes have been decompressed
+func gunzip(r io.Reader) (io.Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReader{gz, *maxDecompressed}, nil
+}
+
+// maybeGunzip returns a reader decompressing r if the data starts with the gzip
+// magic number, otherwise the data is returned as is
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gunzip(br)
+	}
+	return br, nil
+}
+
+// limitedReader is like io.LimitedReader, but returns ErrTooLarge instead of
+// io.EOF when the limit is exceeded so a truncated body can't be mistaken for a
+// complete one
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+	return n, err
+}
+
+func isGzip(encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// acceptsGzip parses an Accept-Encoding header, encodings with q=0 are not
+// acceptable
+func acceptsGzip(header string) bool {
+	for _, enc := range strings.Split(header, ",") {
+		parts := strings.Split(enc, ";")
+		if !isGzip(parts[0]) {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response body, Content-Encoding is set when
+// the header is written unless the status code does not allow a body
+type gzipResponseWriter struct {
+	w           http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) Header() http.Header {
+	return g.w.Header()
+}
+
+func (g *gzipResponseWriter) WriteHeader(s int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	h := g.w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if s != http.StatusNoContent && s != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.w)
+	}
+	g.w.WriteHeader(s)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.w.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+// Close flushes the compressed data
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
 //-----------------------------------------------------------------------------
 // HTTP Request Logging
 //-----------------------------------------------------------------------------
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// imputeStrategies lists the supported values for Schema.Impute, the names
+// follow sklearn.preprocessing.Imputer
+var imputeStrategies = []string{"mean", "median", "most_frequent", "constant"}
+
+// fitImputer computes the fill value for each column according to s.Impute. The
+// mean and median strategies only apply to numeric columns, categorical columns
+// are filled with their most frequent value instead. Columns without any values,
+// or without a value frequent enough to be found by frequentValues, are not
+// filled, see ColumnProfile.NotImputed, multi-hot columns from flattened arrays
+// are filled with 0. For
+// the constant strategy, s.FillValue must be numeric when there are numeric
+// columns; it defaults to 0 for numeric columns and "missing" for categorical
+// columns.
+func (s *Schema) fitImputer(ds *Dataset) error {
+	s.Fill = nil
+	if s.Impute == "" {
+		return nil
+	}
+
+	fill := make(map[string]interface{})
+	for col, typ := range s.Types {
+		if typ == typeNumeric && ds.indicators[col] {
+			fill[col] = 0.0 // multi-hot indicators are absent rather than missing
+			continue
+		}
+		val, err := s.imputeValue(col, typ, ds.stats[col])
+		if err != nil {
+			return SchemaError{fmt.Sprintf("column %q: %v", col, err)}
+		}
+		if val != nil {
+			fill[col] = val
+		}
+	}
+
+	s.Fill = fill
+	return nil
+}
+
+// imputeValue returns the fill value for column col of the given type, nil is
+// returned when there is nothing to fill with. The median is estimated from
+// the column's quantile sketch. Datetime columns are filled with their most
+// frequent timestamp whatever the strategy, or the median timestamp when no
+// timestamp is frequent enough to be tracked, text columns are not filled.
+func (s Schema) imputeValue(col, typ string, stats *columnStats) (interface{}, error) {
+	if typ == typeText {
+		return nil, nil // missing text is an empty document
+	}
+	if typ == typeDatetime {
+		if stats.count == 0 {
+			return nil, nil
+		}
+		if top := stats.frequent.top(1); len(top) > 0 {
+			return top[0].Value, nil
+		}
+		median := stats.epochs.quantile(0.5)
+		return time.Unix(0, int64(median*1e9)).UTC().Format(time.RFC3339Nano), nil
+	}
+
+	if s.Impute == "constant" {
+		if typ == typeCategorical {
+			if s.FillValue == nil {
+				return "missing", nil
+			}
+			return categoricalValue(s.FillValue), nil
+		}
+
+		switch c := s.FillValue.(type) {
+		case nil:
+			return 0.0, nil
+		case float64:
+			return c, nil
+		case string:
+			num, err := strconv.ParseFloat(c, 64)
+			if err != nil {
+				return nil, fmt.Errorf("fill value %q is not numeric", c)
+			}
+			return num, nil
+		default:
+			return nil, fmt.Errorf("fill value %v is not numeric", c)
+		}
+	}
+
+	if stats.count == 0 {
+		return nil, nil
+	}
+
+	if typ == typeCategorical || s.Impute == "most_frequent" {
+		mode, ok := stats.frequent.mode()
+		if !ok {
+			return nil, nil // no value is frequent enough to be the mode
+		}
+		if typ == typeCategorical {
+			return mode, nil
+		}
+		val, _ := s.parseColumn(col, mode)
+		return val, nil
+	}
+
+	if s.Impute == "median" {
+		return stats.quantiles.quantile(0.5), nil
+	}
+	return stats.sum / float64(stats.numeric), nil
+}
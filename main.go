@@ -4,15 +4,23 @@ package main
 This app allows Scikit-Learn classifiers to fitted and used through an HTTP/JSON
 api. Each models is run inside a dedicated python child process. Go communicates with
 each process using zeromq, although using stdin/stdout may also work. The fitting
-script does some primitive model selection. Currently using RandomForestClassifier,
+script does some primitive model selection. By default it uses RandomForestClassifier,
 LogisticRegression, and GradientBoostingClassifier. RandomForestClassifier and
 GradientBoostingClassifier are each called with n_estimators=150, LogisticRegression
-uses the default arguments.
+uses the default arguments. Fit requests can name other candidates from an allow-list
+along with the parameters to search, see Search. Predict requests can be logged,
+see PredictionLog, and replayed against a model with the replay command, see
+runReplay. The rows of predict requests are compared to the training data,
+see Drift, and to the true labels received as feedback, see LiveMetrics. Rows
+to label can be selected from unlabeled pools, see Model.MostUncertain. Models
+are kept on local disk or in S3, see Storage.
 */
 
 import (
 	"flag"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/coreos/go-log/log"
 )
@@ -20,19 +28,89 @@ import (
 var (
 	port     = flag.String("port", "5000", "port for api server")
 	modelDir = flag.String("model-path", "models", "location of model directory")
+
+	maxDecompressed = flag.Int64("max-decompressed-size", 4<<30, "max bytes of a gzip compressed request body or upload after decompression")
+	algorithmsFlag  = flag.String("algorithms", "", "comma separated list of the algorithms fit requests may use, defaults to all supported algorithms")
+
+	predictionLogDir    = flag.String("prediction-log", "", "directory for the prediction log, predict requests are not logged unless set")
+	predictionLogSize   = flag.Int64("prediction-log-max-size", 100<<20, "bytes written to the prediction log before it is rotated")
+	predictionLogFiles  = flag.Int("prediction-log-max-files", 10, "number of rotated prediction logs kept")
+	predictionLogSample = flag.String("prediction-log-sample", "1", "comma separated sampling rates for the prediction log, a rate for all models and <model_id>=<rate> for single models")
+	predictionLogRedact = flag.String("prediction-log-redact", "", "comma separated list of columns whose values are redacted in the prediction log and left out of the predictions saved for feedback")
+
+	driftWindow   = flag.Int("drift-window", 10000, "predict request rows per generation of the drift window, drift is reported over the last one or two generations")
+	driftPSI      = flag.Float64("drift-psi-threshold", 0.2, "population stability index above which a numeric column has drifted")
+	driftDistance = flag.Float64("drift-distance-threshold", 0.1, "largest change in the share of a value above which a categorical column or the predictions have drifted")
+
+	liveMetricsWindow = flag.Int("live-metrics-window", 1000, "number of the newest predictions with feedback the live metrics are computed from")
+	feedbackMaxSize   = flag.Int64("feedback-max-size", 64<<20, "bytes of feedback kept per model, the oldest feedback is dropped once the file is larger")
+	poolDir           = flag.String("pool-path", "pools", "location of the stored unlabeled pools rows are selected from for labeling")
+
+	savedPredictionsSize  = flag.Int64("saved-predictions-max-size", 16<<20, "bytes of predictions saved for feedback in a segment before a new segment is started")
+	savedPredictionsFiles = flag.Int("saved-predictions-max-files", 10, "number of segments of predictions saved for feedback kept per model, feedback for older predictions is not accepted")
+
+	storageFlag = flag.String("storage", "", "where fitted models are kept, s3://<bucket>/<prefix> for S3 or an S3 compatible service, models are then served from copies in the model directory, defaults to the model directory")
+	s3Endpoint  = flag.String("s3-endpoint", "https://s3.amazonaws.com", "url of the S3 API, for S3 compatible services")
+	s3Region    = flag.String("s3-region", "us-east-1", "region requests to the S3 API are signed for")
+	storageSync = flag.Duration("storage-sync-interval", time.Minute, "how often the predictions of models kept in S3 are copied to storage")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := runReplay(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	flag.Parse()
 
-	models := NewModelRepo(*modelDir)
+	if *driftWindow < 1 {
+		log.Fatalln("drift-window should be at least 1")
+	}
+	if *liveMetricsWindow < 1 {
+		log.Fatalln("live-metrics-window should be at least 1")
+	}
+	if *feedbackMaxSize <= 0 {
+		log.Fatalln("feedback-max-size should be positive")
+	}
+	if *savedPredictionsSize <= 0 || *savedPredictionsFiles < 1 {
+		log.Fatalln("saved-predictions-max-size should be positive and saved-predictions-max-files at least 1")
+	}
+
+	var store Storage
+	if *storageFlag != "" {
+		if *storageSync <= 0 {
+			log.Fatalln("storage-sync-interval should be positive")
+		}
+		var err error
+		store, err = newS3Storage(*storageFlag, *s3Endpoint, *s3Region)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	models := NewModelRepo(*modelDir, store)
 
 	log.Info("started indexing model directory")
 	models.IndexModelDir()
 	log.Info("finished indexing model directory")
+	if store != nil {
+		go models.SyncPredictions(*storageSync)
+	}
+
+	var predictions *PredictionLog
+	if *predictionLogDir != "" {
+		var err error
+		predictions, err = NewPredictionLog(*predictionLogDir, *predictionLogSize, *predictionLogFiles, *predictionLogSample, *predictionLogRedact)
+		if err != nil {
+			log.Fatalln("unable to open prediction log ", err)
+		}
+	}
 
-	s := NewAPIHandler(models)
+	s := NewAPIHandler(models, predictions)
 
 	log.Info("listening on http://localhost:" + *port)
-	log.Fatalln(http.ListenAndServe(":"+*port, requestLogger(s)))
+	log.Fatalln(http.ListenAndServe(":"+*port, requestLogger(gzipHandler(s))))
 }
@@ -7,7 +7,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
@@ -15,34 +14,54 @@ import (
 	"github.com/coreos/go-log/log"
 )
 
-// Prediction is the parsed result from the Python worker
+// Prediction is the parsed result from the Python worker, Explanations are
+// only present when requested. IDs identify each predicted row for feedback,
+// see Model.AddFeedback.
 type Prediction struct {
-	ModelID string               `json:"model_id"`
-	Labels  []map[string]float64 `json:"labels"`
+	ModelID      string               `json:"model_id"`
+	IDs          []string             `json:"prediction_ids,omitempty"`
+	Labels       []map[string]float64 `json:"labels"`
+	Explanations []Explanation        `json:"explanations,omitempty"`
 }
 
-// ModelReq represents an incoming request for fit or predict
+// ModelReq represents an incoming request for fit or predict, Explain asks for
+// an explanation of each prediction listing the top ExplainTop input columns
 type ModelReq struct {
-	ModelID      string                   `json:"model_id"`
-	Name         string                   `json:"name"`
-	Date         time.Time                `json:"created_at"`
-	Data         []map[string]interface{} `json:"data"`
-	Labels       []interface{}            `json:"labels"`
-	isRegression bool
+	ModelID    string                   `json:"model_id"`
+	Name       string                   `json:"name"`
+	Date       time.Time                `json:"created_at"`
+	Data       []map[string]interface{} `json:"data"`
+	Labels     []interface{}            `json:"labels"`
+	Explain    bool                     `json:"explain,omitempty"`
+	ExplainTop int                      `json:"explain_top,omitempty"`
+	input      []map[string]interface{} // rows as received, kept for feedback and the prediction log
 }
 
 // Model represents a previously fitted model
 type Model struct {
 	ID       string `json:"model_id"`
 	Metadata struct {
-		Name string    `json:"name"`
-		Date time.Time `json:"created_at"`
+		Name       string         `json:"name"`
+		Date       time.Time      `json:"created_at"`
+		Vocabulary map[string]int `json:"vocabulary,omitempty"` // number of terms kept for each text column
 	} `json:"metadata"`
 	Performance struct {
-		Algorithm       string                        `json:"algorithm"`
-		ConfusionMatrix map[string]map[string]float64 `json:"confusion_matrix,omitempty"`
-		Score           float64                       `json:"score"`
+		Algorithm string                 `json:"algorithm"`
+		Params    map[string]interface{} `json:"params,omitempty"` // parameters chosen by the search
+		// ConfusionMatrix and Metrics are computed from the out-of-fold
+		// predictions of the cross validation, TrainingConfusionMatrix is from
+		// predictions on the data the model was fit on and overstates accuracy
+		ConfusionMatrix         map[string]map[string]float64 `json:"confusion_matrix,omitempty"`
+		TrainingConfusionMatrix map[string]map[string]float64 `json:"training_confusion_matrix,omitempty"`
+		Metrics                 *Metrics                      `json:"metrics,omitempty"`
+		Score                   float64                       `json:"score"`
+		Metric                  string                        `json:"metric,omitempty"` // scoring metric of Score, see scoringMetrics
+		// Live compares recent predictions to the labels received as feedback,
+		// it is nil until feedback is received
+		Live *LiveMetrics `json:"live,omitempty"`
 	} `json:"performance"`
+	Schema  Schema       `json:"schema"`            // how fit/predict data is parsed, saved in <model_id>.schema.json
+	Lineage *Lineage     `json:"lineage,omitempty"` // the model this model was retrained from, see FitConfig
 	runLock sync.RWMutex // protect running attribute
 	Running bool         `json:"running"`
 	Trained bool         `json:"trained"`
@@ -53,6 +72,79 @@ type Model struct {
 	req, rep chan []byte
 	dir      string    // path to the directory containing <model_id>.pkl and <model_id>.json
 	cmd      *exec.Cmd // the running process
+	store    Storage   // where the artifacts in dir are kept, see ModelRepo
+
+	// serialize updates to <model_id>.evaluations.json
+	evalLock sync.Mutex
+
+	// drift of predict requests from the training data, see Model.Drift
+	driftOnce sync.Once
+	drift     *driftMonitor
+	driftErr  error
+
+	// serialize appends to the saved predictions, see Model.savePredictions,
+	// segment is the segment rows are appended to, 0 until it's first
+	// needed, and segmentSize its size in bytes. The segments up to synced
+	// are in storage, unsynced is set when rows were appended to segment
+	// since it was stored, see Model.persistPredictions.
+	predictionsLock sync.Mutex
+	segment         int
+	segmentSize     int64
+	synced          int
+	unsynced        bool
+
+	// serialize updates to <model_id>.feedback.jsonl and
+	// <model_id>.batches.json, and to window, the newest feedback the live
+	// metrics are computed from
+	feedbackLock sync.Mutex
+	window       feedbackWindow
+
+	// protect Performance.Live, replaced as feedback is received
+	liveLock sync.RWMutex
+}
+
+// MarshalJSON encodes the model as returned by the api, reading the live
+// metrics and the running attribute under their locks
+func (m *Model) MarshalJSON() ([]byte, error) {
+	m.liveLock.RLock()
+	perf := m.Performance
+	m.liveLock.RUnlock()
+
+	m.runLock.RLock()
+	running := m.Running
+	m.runLock.RUnlock()
+
+	return json.Marshal(struct {
+		ID          string      `json:"model_id"`
+		Metadata    interface{} `json:"metadata"`
+		Performance interface{} `json:"performance"`
+		Schema      Schema      `json:"schema"`
+		Lineage     *Lineage    `json:"lineage,omitempty"`
+		Running     bool        `json:"running"`
+		Trained     bool        `json:"trained"`
+	}{m.ID, m.Metadata, perf, m.Schema, m.Lineage, running, m.Trained})
+}
+
+// Metrics describes how well a classifier's predictions match the true labels,
+// R2 and RMSE are only computed for numeric labels
+type Metrics struct {
+	Accuracy    float64                 `json:"accuracy"`
+	Classes     map[string]ClassMetrics `json:"classes"` // keyed by label
+	MacroAvg    ClassMetrics            `json:"macro_avg"`
+	WeightedAvg ClassMetrics            `json:"weighted_avg"`      // weighted by support
+	ROCAUC      *float64                `json:"roc_auc,omitempty"` // mean one vs rest AUC
+	LogLoss     *float64                `json:"log_loss,omitempty"`
+	R2          *float64                `json:"r2,omitempty"`
+	RMSE        *float64                `json:"rmse,omitempty"`
+}
+
+// ClassMetrics are the precision, recall, and F1 score of the predictions for a
+// class, Support is the number of rows with the class as the true label
+type ClassMetrics struct {
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+	Support   int     `json:"support"`
 }
 
 // Predict encodes the client supplied data, passes it to the Python process for
@@ -73,7 +165,10 @@ func (m *Model) Predict(r ModelReq) Prediction {
 	m.req <- buf.Bytes()
 	resp := <-m.rep
 
-	var pred []map[string]float64
+	var pred struct {
+		Labels       []map[string]float64 `json:"labels"`
+		Explanations []rawExplanation     `json:"explanations"`
+	}
 	err = json.NewDecoder(bytes.NewReader(resp)).Decode(&pred)
 	if err != nil {
 		log.Error("error decoding prediction ", err)
@@ -81,7 +176,10 @@ func (m *Model) Predict(r ModelReq) Prediction {
 
 	prediction := Prediction{
 		ModelID: r.ModelID,
-		Labels:  pred,
+		Labels:  pred.Labels,
+	}
+	if r.Explain {
+		prediction.Explanations = m.Schema.explain(pred.Explanations, r.ExplainTop)
 	}
 
 	return prediction
@@ -95,19 +193,48 @@ func (m *Model) Stop() error {
 	return nil
 }
 
-// ModelRepo represents a collection of models
+// Candidate is an algorithm and parameter setting tried when fitting a model,
+// along with its cross validation results
+type Candidate struct {
+	Rank      int                    `json:"rank"`
+	Algorithm string                 `json:"algorithm"`
+	Params    map[string]interface{} `json:"params"`
+	Scores    []float64              `json:"scores"` // score for each fold
+	MeanScore float64                `json:"mean_score"`
+	StdScore  float64                `json:"std_score"`
+	FitTime   float64                `json:"fit_time"` // mean seconds to fit a fold
+}
+
+// Leaderboard returns every candidate tried when fitting the model, best first.
+// The leaderboard is saved by fit.py in <model_id>.leaderboard.json, an error
+// satisfying os.IsNotExist is returned for models fit without one.
+func (m *Model) Leaderboard() ([]Candidate, error) {
+	var candidates []Candidate
+	err := readJSONFile(filepath.Join(m.dir, m.ID+".leaderboard.json"), &candidates)
+	return candidates, err
+}
+
+// ModelRepo represents a collection of models. Models are kept in a Storage
+// and served from a local copy of their artifacts in the model directory, which
+// may be the storage itself, see localStorage.
 type ModelRepo struct {
 	sync.RWMutex
 	collection map[string]*Model
 	path       string
+	store      Storage
 }
 
 // NewModelRepo initializes and returns a pointer to a ModelRepo, the supplied
-// path argument refers to the directory where pickled models will be saved.
-func NewModelRepo(path string) *ModelRepo {
+// path argument refers to the directory where pickled models will be saved and
+// models in store are copied to, store is localStorage for path when nil.
+func NewModelRepo(path string, store Storage) *ModelRepo {
+	if store == nil {
+		store = localStorage{path}
+	}
 	return &ModelRepo{
 		collection: make(map[string]*Model),
 		path:       path,
+		store:      store,
 	}
 }
 
@@ -130,7 +257,7 @@ func (r *ModelRepo) Remove(id string) {
 // NewModel initializes a model with a generated ID and dir
 func (r *ModelRepo) NewModel() *Model {
 	id := uuid.New()
-	m := Model{ID: id, dir: filepath.Join(r.path, id)}
+	m := Model{ID: id, dir: filepath.Join(r.path, id), store: r.store}
 	return &m
 }
 
@@ -147,12 +274,13 @@ func (r *ModelRepo) All() []*Model {
 	return models
 }
 
-// ErrModelNotFound is returned when the model can't be found in the model dir
+// ErrModelNotFound is returned when the model can't be found in storage
 var ErrModelNotFound = errors.New("model not found")
 
 // Get fetches a model by id, if the model is not present in the collection, it
-// will attempt to load from disk adding it to the collection. If the model is
-// not in the model directory, Get will return ErrModelNotFound.
+// will attempt to load from storage adding it to the collection. If the model is
+// not in storage, Get will return ErrModelNotFound. The pickled model is copied
+// to the model directory before the model is started.
 func (r *ModelRepo) Get(id string) (*Model, error) {
 	r.RLock()
 	m, ok := r.collection[id]
@@ -172,6 +300,10 @@ func (r *ModelRepo) Get(id string) (*Model, error) {
 	m.runLock.Lock() // make sure we don't start twice
 	defer m.runLock.Unlock()
 	if !m.Running {
+		err = m.fetch(m.ID + ".pkl")
+		if err != nil {
+			return nil, err
+		}
 		err = startModel(m)
 		if err != nil {
 			return nil, err
@@ -181,10 +313,15 @@ func (r *ModelRepo) Get(id string) (*Model, error) {
 	return m, nil
 }
 
-// LoadModelData loads the model metadata from the file
-// <path>/<model_id>/<model_id>.json, if the file does not exist, ErrModelNotFound
-// is returned. The json file is expected to contain the model score, confusion matrix,
-// and algorithm used, see Model.Metadata. The loaded model is added to the collection.
+// LoadModelData loads the model metadata from the artifact <model_id>.json of
+// storage, if the model is not stored, ErrModelNotFound is returned. Artifacts
+// missing from the model directory are copied there, except for those fetched
+// when needed, see lazyArtifact. The json file is expected to contain the
+// model score, confusion matrix, and algorithm used, see Model.Metadata. The
+// schema used to parse fit data is loaded from
+// <path>/<model_id>/<model_id>.schema.json when present, the live metrics from
+// the feedback received, and the lineage of retrained models from
+// <model_id>.fit.json. The loaded model is added to the collection.
 func (r *ModelRepo) LoadModelData(id string) (*Model, error) {
 	// check the collection first
 	r.RLock()
@@ -192,38 +329,85 @@ func (r *ModelRepo) LoadModelData(id string) (*Model, error) {
 	r.RUnlock()
 	if !ok { // not currently loaded
 		modelDir := filepath.Join(r.path, id)
-		f, err := os.Open(filepath.Join(modelDir, id+".json"))
-		if os.IsNotExist(err) {
-			return nil, ErrModelNotFound
-		}
-
+		f, err := r.store.Metadata(id)
 		if err != nil {
 			return nil, err
 		}
+		defer f.Close()
 
-		var m Model
-		err = json.NewDecoder(f).Decode(&m)
+		m = &Model{}
+		err = json.NewDecoder(f).Decode(m)
 		if err != nil {
 			return nil, err
 		}
 		m.dir = modelDir
+		m.store = r.store
 		m.Trained = true
 
-		r.Add(&m) // add to cache
+		err = cacheModel(r.store, id, modelDir)
+		if err != nil {
+			return nil, err
+		}
+
+		err = readJSONFile(filepath.Join(modelDir, id+".schema.json"), &m.Schema)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		err = m.loadFeedback()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err := m.FitConfig()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		m.Lineage = cfg.Lineage
+
+		r.Add(m) // add to cache
 	}
 
 	return m, nil
 }
 
+// IndexModelDir loads every stored model into the collection, see
+// LoadModelData
 func (r *ModelRepo) IndexModelDir() error {
-	models, err := filepath.Glob(filepath.Join(r.path, "/*"))
+	ids, err := r.store.List()
 	if err != nil {
 		return err
 	}
 
-	for _, model := range models {
-		modelID := strings.TrimPrefix(model, r.path+"/")
+	for _, modelID := range ids {
 		r.LoadModelData(modelID)
 	}
 	return nil
 }
+
+// readJSONFile decodes the json file at path into v
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// writeJSONFile encodes v as json to the file at path, replacing any existing
+// file
+func writeJSONFile(path string, v interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(f).Encode(v)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
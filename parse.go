@@ -1,21 +1,20 @@
 package main
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
-	"strconv"
+	"os"
+	"path/filepath"
 	"strings"
-
-	"github.com/coreos/go-log/log"
 )
 
-// ParseJSON parses a JSON encoded request:
+// ParseJSON parses a JSON encoded predict request:
 //
 //		{
-//			"name": "iris model",
 //			"data": [
 //				{
 //					"var_1": 2.5,
@@ -23,161 +22,451 @@ import (
 //					...
 //				},
 //				...
-//			],
-//			"labels": [
-//				"yes",
-//				"no",
-//				...
 //			]
 //		}
 //
-// into a ModelReq struct. If the hasTarget arg is true, ParseJSON will also set
-// the isRegression attribute if the returned ModelReq if all the values in the
-// label slice can be parsed as floats.
-func ParseJSON(r io.Reader, hasTarget bool) (ModelReq, error) {
+// into a ModelReq struct. The rows are transformed according to the schema
+// saved with the model, see Schema.Apply. Fit requests are read by SpoolJSON.
+func ParseJSON(r io.Reader, s Schema) (ModelReq, error) {
 	var d ModelReq
 	err := json.NewDecoder(r).Decode(&d)
 	if err != nil {
 		return ModelReq{}, err
 	}
 
-	// the json decoder will correctly parse string vs float for the label slice
-	// check a few values to determine if this is a regression or classification
-	// task
-	if hasTarget {
-		allFloats := true
-		for _, val := range d.Labels {
-			_, ok := val.(float64)
-			if !ok {
-				allFloats = false
-				break
-			}
-		}
-		d.isRegression = allFloats
-	}
+	s.Apply(&d)
 
 	return d, nil
 }
 
-// ParseCSV parses a csv file with the following format:
+// input formats for fit and predict data besides JSON requests, selected by
+// the content type of the request or uploaded file, or the format form field
+const (
+	formatCSV      = "csv"
+	formatTSV      = "tsv"
+	formatNDJSON   = "ndjson"
+	formatSVMLight = "svmlight"
+)
+
+// formatFromMediaType returns the input format for a content type, the empty
+// string is returned for unknown types
+func formatFromMediaType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return formatCSV
+	case "text/tab-separated-values":
+		return formatTSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonlines", "application/x-jsonlines":
+		return formatNDJSON
+	case "text/x-svmlight", "application/x-svmlight", "text/x-libsvm", "application/x-libsvm":
+		return formatSVMLight
+	}
+	return ""
+}
+
+// formatFromFileName returns the input format for a file extension, ignoring
+// any .gz suffix, the empty string is returned for unknown extensions
+func formatFromFileName(name string) string {
+	switch filepath.Ext(strings.TrimSuffix(strings.ToLower(name), ".gz")) {
+	case ".csv":
+		return formatCSV
+	case ".tsv", ".tab":
+		return formatTSV
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	case ".svm", ".svmlight", ".libsvm":
+		return formatSVMLight
+	}
+	return ""
+}
+
+// ParseCSV parses delimited text data with the following format:
 //
-//		<target_var>,<var_1>,<var_2>,...<var_n>
-//		"true",1.5,"red",...
+//		<var_1>,<var_2>,...<var_n>
+//		1.5,"red",...
 //
-// returning a slice of maps representing the feature:value pairs for each row,
-// a slice of labels, and an error. If the hasTarget flag is true, the first
-// column of input data will be copied to the label slice and excluded from the
-// feature:value pairs. If hasTarget is false, the label slice will be empty and
-// all columns will be included in the feature:value pairs.
-func ParseCSV(r io.Reader, hasTarget bool) (ModelReq, error) {
-	reader := csv.NewReader(r)
-
-	// grab the var names from the first row
-	fieldNames, err := reader.Read()
+// returning a ModelReq with a map representing the feature:value pairs for
+// each row. The data is read according to the dialect in the schema saved with
+// the model and the rows are transformed the same way as the training data, see
+// Schema.Apply, the target column is dropped if present. Csv files used for
+// fitting a model are read by SpoolCSV.
+func ParseCSV(r io.Reader, s Schema) (ModelReq, error) {
+	var d ModelReq
+	err := eachCSVRow(r, s, func(row map[string]interface{}) error {
+		d.Data = append(d.Data, row)
+		return nil
+	})
 	if err != nil {
 		return ModelReq{}, err
 	}
 
-	xStart := 0 // column where feature data starts
-	if hasTarget {
-		xStart = 1
-	}
+	s.Apply(&d)
 
-	var d ModelReq
-	allFloats := true // regression if all labels are floats, classification otherwise
+	return d, nil
+}
+
+// eachCSVRow calls fn with each row of delimited text data as read, before the
+// schema is applied
+func eachCSVRow(r io.Reader, s Schema, fn func(row map[string]interface{}) error) error {
+	reader, err := s.Dialect.newReader(r, s.Target)
+	if err != nil {
+		return err
+	}
+	fieldNames := reader.Header
 
 	for {
 		row, err := reader.Read()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			return ModelReq{}, err
+			return err
 		}
 
 		if len(row) != len(fieldNames) {
-			return ModelReq{}, errors.New("mlserver: csv header and row length mismatch")
+			return errors.New("mlserver: csv header and row length mismatch")
 		}
 
-		if hasTarget { // first column is the target variable
-			// check if float
-			numVal, err := strconv.ParseFloat(row[0], 64)
-			if err != nil {
-				d.Labels = append(d.Labels, row[0])
-				allFloats = false
-			} else {
-				d.Labels = append(d.Labels, numVal)
-			}
+		// save as <feature_name>:<value> pairs, values are converted by the schema
+		features := make(map[string]interface{})
+		for i, val := range row {
+			features[fieldNames[i]] = val
+		}
+		err = fn(features)
+		if err != nil {
+			return err
 		}
+	}
+}
 
-		// save the rest as <feature_name>:<value> pairs
-		features := make(map[string]interface{})
-		for i := xStart; i < len(row); i++ {
-			val := row[i]
-			// check for numeric value
-			numVal, err := strconv.ParseFloat(row[i], 64)
-			if err != nil {
-				features[fieldNames[i]] = val // use string val
-			} else {
-				features[fieldNames[i]] = numVal // use numeric val
+// ParseNDJSON parses newline delimited JSON, each line holding an object with
+// the feature:value pairs for a single row. The rows are transformed according
+// to the schema saved with the model, see Schema.Apply.
+func ParseNDJSON(r io.Reader, s Schema) (ModelReq, error) {
+	var d ModelReq
+	err := eachNDJSONRow(r, func(row map[string]interface{}) error {
+		d.Data = append(d.Data, row)
+		return nil
+	})
+	if err != nil {
+		return ModelReq{}, err
+	}
+
+	s.Apply(&d)
+
+	return d, nil
+}
+
+// eachNDJSONRow calls fn with each row of newline delimited JSON as read
+func eachNDJSONRow(r io.Reader, fn func(row map[string]interface{}) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var row map[string]interface{}
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return errors.New("mlserver: data rows must be JSON objects")
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maxFormValue is the size limit for multipart form fields other than the file
+const maxFormValue = 1 << 20
+
+// ErrCSVFileMissing is returned when a multipart request has no file
+// associated with the key 'file'
+var ErrCSVFileMissing = errors.New("csv file missing")
+
+// readMultipart reads a multipart/form-data request one part at a time, the
+// part with the key 'file' is passed to fn as it is read, gzip compressed files
+// are decompressed. The remaining fields are returned along with the format of
+// the file, determined from its content type or extension. Nothing is buffered
+// in memory or on disk besides what fn does with the file.
+func readMultipart(r *http.Request, fn func(io.Reader) error) (map[string][]string, string, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := make(map[string][]string)
+	format := ""
+	hasFile := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		name := part.FormName()
+		if name == "file" && !hasFile {
+			hasFile = true
+			format = formatFromMediaType(part.Header.Get("Content-Type"))
+			if format == "" {
+				format = formatFromFileName(part.FileName())
+			}
+
+			var f io.Reader
+			f, err = maybeGunzip(part)
+			if err == nil {
+				err = fn(f)
+			}
+		} else {
+			var b []byte
+			b, err = ioutil.ReadAll(io.LimitReader(part, maxFormValue+1))
+			if len(b) > maxFormValue {
+				err = errors.New("mlserver: form field " + name + " too large")
 			}
+			form[name] = append(form[name], string(b))
+		}
+		part.Close()
+		if err != nil {
+			return nil, "", err
 		}
-		d.Data = append(d.Data, features)
 	}
 
-	if hasTarget {
-		d.isRegression = allFloats
+	if !hasFile {
+		return nil, "", ErrCSVFileMissing
 	}
+	return form, format, nil
+}
 
-	return d, nil
+// selectFormat returns the format form field or query parameter if present,
+// otherwise the format determined from the content type. libsvm is accepted
+// as another name for svmlight.
+func selectFormat(format string, form map[string][]string) string {
+	if f := formValue(form, "format"); f != "" {
+		format = strings.ToLower(f)
+	}
+	if format == "libsvm" {
+		return formatSVMLight
+	}
+	return format
 }
 
-// parseFileUpload parses ModelReq from a csv file uploaded in a POST request.
-// the hasTarget arg should be true when the uploaded csv file has the target
-// variable in the first column (i.e. when parsing a request for fitting a model).
-// ErrCSVFileMissing will be returned if there is no file associated with the key
-// 'file'.
-func parseFileUpload(r *http.Request, hasTarget bool) (ModelReq, error) {
+// spoolRequest spools labeled data from an http request to disk, the data is
+// either a JSON encoded request body, a file uploaded as multipart/form-data, or
+// a csv, tsv, ndjson, or svmlight request body. The form fields, or query string
+// for request bodies other than JSON, are returned along with the format of the
+// data, the form is nil for JSON requests. The caller is responsible for
+// removing the returned Dataset.
+func spoolRequest(r *http.Request) (*Dataset, map[string][]string, string, error) {
+	var ds *Dataset
+	var form map[string][]string
+	var err error
+
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	format := formatFromMediaType(contentType)
+
+	switch {
+	case mediaType == "application/json":
+		ds, err = SpoolJSON(r.Body)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return ds, nil, formatNDJSON, nil
+
+	case format != "":
+		form = r.URL.Query()
+		ds, err = SpoolCSV(r.Body)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+	default:
+		form, format, err = readMultipart(r, func(f io.Reader) error {
+			var err error
+			ds, err = SpoolCSV(f)
+			return err
+		})
+		if err != nil {
+			if ds != nil {
+				ds.Remove()
+			}
+			return nil, nil, "", err
+		}
+	}
 
-	err := r.ParseMultipartForm(1 << 28)
+	format = selectFormat(format, form)
+	if format == formatNDJSON || format == formatSVMLight {
+		ds.format = format
+	}
+	return ds, form, format, nil
+}
+
+// parseFitRequest spools the training data from an http request to disk and
+// profiles it, see Dataset.Profile, then checks the model search options, see
+// Search.Resolve. The data is read by spoolRequest. For requests other than JSON
+// the name, schema, csv dialect, search, and snapshot options are read from the
+// form fields or query string, see schemaFromForm, readDialect, searchFromForm,
+// and snapshotFromForm.
+// The caller is responsible for removing the returned Dataset.
+func parseFitRequest(r *http.Request) (*Dataset, error) {
+	ds, form, format, err := spoolRequest(r)
 	if err != nil {
-		return ModelReq{}, err
+		return nil, err
 	}
 
-	defer func() {
-		err := r.MultipartForm.RemoveAll()
+	if form != nil {
+		ds.Name = strings.Join(form["name"], " ")
+		ds.Schema, err = schemaFromForm(form)
+		if err == nil {
+			ds.Schema.Dialect, err = readDialect(Dialect{}, format, form)
+		}
+		if err == nil {
+			ds.Search, err = searchFromForm(form)
+		}
+		if err == nil {
+			ds.Snapshot, err = snapshotFromForm(form)
+		}
 		if err != nil {
-			log.Error("error removing file uploads ", err)
+			ds.Remove()
+			return nil, err
 		}
-	}()
+	}
 
-	files, ok := r.MultipartForm.File["file"]
-	if !ok || len(files) < 1 {
-		return ModelReq{}, errors.New("csv file missing")
+	ds.requested = ds.Schema
+	err = ds.Profile()
+	if err == nil {
+		err = ds.Search.Resolve(ds)
 	}
+	if err != nil {
+		ds.Remove()
+		return nil, err
+	}
+
+	return ds, nil
+}
 
-	f, err := files[0].Open()
+// parseEvaluateRequest spools labeled data from an http request to disk, see
+// spoolRequest, to be read with the schema saved with the model. Csv dialect
+// options in the form fields or query string override the dialect saved with
+// the model, other schema options in the request are ignored. The caller is
+// responsible for removing the returned Dataset.
+func parseEvaluateRequest(r *http.Request, s Schema) (*Dataset, error) {
+	ds, form, format, err := spoolRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if form != nil {
+		ds.Name = strings.Join(form["name"], " ")
+		s.Dialect, err = readDialect(s.Dialect, format, form)
+		if err != nil {
+			ds.Remove()
+			return nil, err
+		}
+	}
+	ds.Schema = s
+
+	return ds, nil
+}
+
+// parsePredictRequest parses an http request into a ModelReq struct using the
+// schema saved with the model. The appropriate parser (json, csv, ndjson, or
+// svmlight) is determined from the content-type, the content type of the
+// uploaded file, or the format form field. Csv dialect options in the form
+// fields or query string override the dialect saved with the model.
+// Explanations are requested with the explain and explain_top fields, see
+// explainFromForm.
+func parsePredictRequest(r *http.Request, s Schema) (ModelReq, error) {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" {
+		d, err := ParseJSON(r.Body, s)
+		if err != nil {
+			return ModelReq{}, err
+		}
+		err = explainFromForm(r.URL.Query(), &d)
+		return d, err
+	}
+
+	var data io.Reader
+	var form map[string][]string
+	format := formatFromMediaType(contentType)
+
+	if format != "" {
+		data, form = r.Body, r.URL.Query()
+	} else {
+		// the format field may follow the file, so the file is spooled to
+		// disk like uploaded training data
+		var path string
+		var err error
+		form, format, err = readMultipart(r, func(f io.Reader) error {
+			var err error
+			path, err = spool(f)
+			return err
+		})
+		if path != "" {
+			defer os.Remove(path)
+		}
+		if err != nil {
+			return ModelReq{}, err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return ModelReq{}, err
+		}
+		defer f.Close()
+		data = f
+	}
+
+	format = selectFormat(format, form)
+
+	var err error
+	s.Dialect, err = readDialect(s.Dialect, format, form)
 	if err != nil {
 		return ModelReq{}, err
 	}
-	defer f.Close()
 
-	d, err := ParseCSV(f, hasTarget)
+	d, err := parseData(data, format, s)
 	if err != nil {
 		return ModelReq{}, err
 	}
 
-	d.Name = strings.Join(r.MultipartForm.Value["name"], " ")
+	err = explainFromForm(form, &d)
+	return d, err
+}
 
-	return d, nil
+// eachRow calls fn with each row of ndjson, svmlight, or delimited text data as
+// read, before the schema is applied, so data can be read without holding every
+// row in memory
+func eachRow(r io.Reader, format string, s Schema, fn func(row map[string]interface{}) error) error {
+	switch format {
+	case formatNDJSON:
+		return eachNDJSONRow(r, fn)
+	case formatSVMLight:
+		return readSVMLight(r, func(n int, label string, row map[string]interface{}) error {
+			return fn(row)
+		})
+	default:
+		return eachCSVRow(r, s, fn)
+	}
 }
 
-// parseFitPredictRequest parses an http request into a ModelReq struct. The appropriate
-// parser (json or csv) is determined from the content-type.
-func parseFitPredictRequest(r *http.Request, isFitReq bool) (ModelReq, error) {
-	if r.Header.Get("Content-Type") == "application/json" {
-		return ParseJSON(r.Body, isFitReq)
-	} else {
-		return parseFileUpload(r, isFitReq)
+// parseData parses ndjson, svmlight, or delimited text data for a model, see
+// ParseNDJSON, ParseSVMLight, and ParseCSV
+func parseData(r io.Reader, format string, s Schema) (ModelReq, error) {
+	switch format {
+	case formatNDJSON:
+		return ParseNDJSON(r, s)
+	case formatSVMLight:
+		return ParseSVMLight(r, s)
+	default:
+		return ParseCSV(r, s)
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// multipartRequest returns a request uploading data as a file named name along
+// with the form fields
+func multipartRequest(t *testing.T, name, data string, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for key, val := range fields {
+		w.WriteField(key, val)
+	}
+	f, err := w.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(data))
+	w.Close()
+
+	r, err := http.NewRequest("POST", "/models", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+func TestPredictUsesFitDelimiter(t *testing.T) {
+	train := "size;color;label\n1;red;a\n2;blue;b\n3;red;a\n4;blue;b\n"
+	ds, err := parseFitRequest(multipartRequest(t, "train.csv", train, map[string]string{"delimiter": ";", "target": "label"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Remove()
+
+	d, err := parsePredictRequest(multipartRequest(t, "rows.csv", "size;color\n5;red\n", nil), ds.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{"size": 5.0, "color": "red"}}
+	if !reflect.DeepEqual(d.Data, want) {
+		t.Errorf("predict rows %v, want %v", d.Data, want)
+	}
+
+	// a tsv upload is tab separated whatever the saved delimiter
+	d, err = parsePredictRequest(multipartRequest(t, "rows.tsv", "size\tcolor\n6\tblue\n", nil), ds.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []map[string]interface{}{{"size": 6.0, "color": "blue"}}
+	if !reflect.DeepEqual(d.Data, want) {
+		t.Errorf("tsv predict rows %v, want %v", d.Data, want)
+	}
+}
+
+func TestParseNDJSON(t *testing.T) {
+	s := Schema{Target: "label", Types: map[string]string{"x": typeNumeric, "c": typeCategorical}}
+	d, err := ParseNDJSON(strings.NewReader("{\"x\": 1, \"c\": \"a\", \"label\": \"y\"}\n\n{\"x\": \"2\", \"c\": 3}\n"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{"x": 1.0, "c": "a"}, {"x": 2.0, "c": "3"}}
+	if !reflect.DeepEqual(d.Data, want) {
+		t.Errorf("rows %v, want %v", d.Data, want)
+	}
+
+	for _, data := range []string{"[1, 2]\n", "{\"x\": 1\n", "null\n"} {
+		if _, err := ParseNDJSON(strings.NewReader(data), s); err == nil {
+			t.Errorf("ParseNDJSON(%q): expected an error", data)
+		}
+	}
+}
+
+func TestFormatDetection(t *testing.T) {
+	types := []struct{ contentType, format string }{
+		{"text/csv; charset=utf-8", formatCSV},
+		{"text/tab-separated-values", formatTSV},
+		{"application/x-ndjson", formatNDJSON},
+		{"text/x-svmlight", formatSVMLight},
+		{"application/octet-stream", ""},
+	}
+	for _, tt := range types {
+		if got := formatFromMediaType(tt.contentType); got != tt.format {
+			t.Errorf("formatFromMediaType(%q) = %q, want %q", tt.contentType, got, tt.format)
+		}
+	}
+
+	names := []struct{ name, format string }{
+		{"train.CSV", formatCSV},
+		{"train.tsv.gz", formatTSV},
+		{"rows.jsonl", formatNDJSON},
+		{"data.libsvm", formatSVMLight},
+		{"notes.txt", ""},
+	}
+	for _, tt := range names {
+		if got := formatFromFileName(tt.name); got != tt.format {
+			t.Errorf("formatFromFileName(%q) = %q, want %q", tt.name, got, tt.format)
+		}
+	}
+}
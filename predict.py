@@ -1,14 +1,103 @@
 import zmq
 import signal
 import sys
+import scipy.sparse
 from sklearn.externals import joblib
 
-def predict(model, X):
+def predict(model, X, explanations=False):
 	predictions = []
 	labels = [str(label) for label in model.steps[-1][-1].classes_]
-	for prediction in model.predict_proba(X):
+	probabilities = model.predict_proba(X)
+	for prediction in probabilities:
 		predictions.append({labels[lab]: prob for lab, prob in enumerate(prediction)})
-	return predictions
+	if not explanations:
+		return {"labels": predictions}
+	return {"labels": predictions, "explanations": explain(model, X, probabilities)}
+
+def contributions_row(Xt, i):
+	"""the non-zero values of row i of the vectorized data as index:value pairs"""
+	row = scipy.sparse.csr_matrix(Xt[i])
+	return dict(zip(row.indices, row.data))
+
+def explain_linear(clf, Xt, i, k):
+	"""exact contributions of a linear model toward class k, the coefficient
+	times the value of each feature, binary models have a single set of
+	coefficients for the second class"""
+	sign = 1.0
+	coef, intercept = clf.coef_, clf.intercept_
+	if coef.shape[0] == 1:
+		sign, k = (1.0 if k == 1 else -1.0), 0
+	contributions = {j: sign * coef[k, j] * val for j, val in contributions_row(Xt, i).items()}
+	return sign * intercept[k], contributions
+
+def tree_path(tree, x, value, contributions, scale):
+	"""walk the decision path of x, adding the change in value at each split
+	to the contribution of the feature split on, returns the value at the root"""
+	t = tree.tree_
+	node = 0
+	while t.children_left[node] != -1:
+		f = t.feature[node]
+		child = t.children_left[node] if x[f] <= t.threshold[node] else t.children_right[node]
+		contributions[f] = contributions.get(f, 0.0) + scale * (value(t, child) - value(t, node))
+		node = child
+	return value(t, 0)
+
+def explain_forest(clf, Xt, i, k):
+	"""tree path contributions toward the probability of class k, averaged over
+	the trees of a random forest"""
+	x = Xt[i]
+	def proba(t, node):
+		counts = t.value[node][0]
+		return counts[k] / counts.sum()
+
+	contributions = {}
+	scale = 1.0 / len(clf.estimators_)
+	bias = sum(scale * tree_path(tree, x, proba, contributions, scale) for tree in clf.estimators_)
+	return bias, contributions
+
+def explain_boosting(clf, Xt, i, k):
+	"""tree path contributions toward the decision function of class k, summed
+	over the stages of gradient boosting, the bias is the initial prediction.
+	Binary models have a single decision function for the second class."""
+	sign = 1.0
+	if clf.estimators_.shape[1] == 1:
+		sign, k = (1.0 if k == 1 else -1.0), 0
+	x = Xt[i]
+	def leaf(t, node):
+		return t.value[node][0][0]
+
+	contributions = {}
+	for tree in clf.estimators_[:, k]:
+		tree_path(tree, x, leaf, contributions, sign * clf.learning_rate)
+	decision = clf.decision_function(Xt[i:i + 1]).ravel()
+	bias = sign * decision[k] - sum(contributions.values())
+	return bias, contributions
+
+EXPLAINERS = {
+	'LogisticRegression': explain_linear,
+	'SGDClassifier': explain_linear,
+	'RandomForestClassifier': explain_forest,
+	'GradientBoostingClassifier': explain_boosting
+}
+
+def explain(model, X, probabilities):
+	"""the contribution of each vectorized feature toward the predicted class
+	of every row, features that don't contribute are left out"""
+	vec, clf = model.steps[0][-1], model.steps[-1][-1]
+	explainer = EXPLAINERS[clf.__class__.__name__]
+	names = vec.get_feature_names()
+	Xt = vec.transform(X)
+
+	explanations = []
+	for i, proba in enumerate(probabilities):
+		k = proba.argmax()
+		bias, contributions = explainer(clf, Xt, i, k)
+		explanations.append({
+			"class": str(clf.classes_[k]),
+			"bias": float(bias),
+			"features": {names[j]: float(c) for j, c in contributions.items() if c != 0}
+		})
+	return explanations
 
 def load(path):
 	return joblib.load(path)
@@ -23,7 +112,7 @@ def run(model_path, socket_path):
 	try:
 		while True:
 			message = socket.recv_json()
-			predictions = predict(model, message['data'])
+			predictions = predict(model, message['data'], message.get('explain', False))
 			socket.send_json(predictions)
 	finally:
 		context.destroy()
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// redacted replaces the values of redacted columns in the prediction log
+const redacted = "[redacted]"
+
+// redactColumns returns the columns named by -prediction-log-redact, their
+// values are redacted in the prediction log and left out of the predictions
+// saved for feedback
+func redactColumns() map[string]bool {
+	redact := make(map[string]bool)
+	for _, col := range splitFormList([]string{*predictionLogRedact}) {
+		redact[col] = true
+	}
+	return redact
+}
+
+// PredictionRecord is a single predict request written to the prediction log.
+// Data holds the rows as received, before the schema is applied, so the
+// request can be replayed against any model, see runReplay.
+type PredictionRecord struct {
+	RequestID    string                   `json:"request_id"`
+	Time         time.Time                `json:"time"`
+	ModelID      string                   `json:"model_id"`
+	ModelVersion string                   `json:"model_version"` // created_at of the model
+	Data         []map[string]interface{} `json:"data"`
+	Labels       []map[string]float64     `json:"labels"`
+	Latency      float64                  `json:"latency_ms"` // from receiving the request to the prediction
+}
+
+// PredictionLog writes sampled predict requests as JSON lines to
+// <dir>/predictions.jsonl. When the file would exceed maxSize bytes it is
+// renamed with the time of rotation, predictions-20141106T215216.000000000.jsonl,
+// and only the newest maxFiles rotated files are kept.
+type PredictionLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	rates    map[string]float64 // sampling rate by model id
+	rate     float64            // sampling rate of other models
+	redact   map[string]bool
+
+	mu   sync.Mutex // protects the fields below
+	f    *os.File
+	size int64
+	rand *rand.Rand
+}
+
+// NewPredictionLog opens the prediction log in dir. sample is a comma separated
+// list of sampling rates between 0 and 1, a bare rate applies to all models and
+// <model_id>=<rate> to a single model, e.g. "0.1,0e12bb73-...=1". redact is a
+// comma separated list of columns whose values are replaced by [redacted].
+func NewPredictionLog(dir string, maxSize int64, maxFiles int, sample, redact string) (*PredictionLog, error) {
+	l := &PredictionLog{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		rates:    make(map[string]float64),
+		rate:     1,
+		redact:   make(map[string]bool),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, item := range splitFormList([]string{sample}) {
+		id, val := "", item
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			id, val = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("mlserver: prediction log sampling rate %q should be between 0 and 1", item)
+		}
+		if id == "" {
+			l.rate = rate
+		} else {
+			l.rates[id] = rate
+		}
+	}
+	for _, col := range splitFormList([]string{redact}) {
+		l.redact[col] = true
+	}
+	if maxSize <= 0 || maxFiles < 0 {
+		return nil, errors.New("mlserver: prediction log size and file limits should be positive")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = l.open()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Sampled reports if a predict request for the model should be logged
+func (l *PredictionLog) Sampled(modelID string) bool {
+	if l == nil {
+		return false
+	}
+	rate, ok := l.rates[modelID]
+	if !ok {
+		rate = l.rate
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rand.Float64() < rate
+}
+
+// Write appends rec to the log, redacting the configured columns, and rotates
+// the log once it is too large
+func (l *PredictionLog) Write(rec PredictionRecord) error {
+	for _, row := range rec.Data {
+		for col := range row {
+			if l.redact[col] {
+				row[col] = redacted
+			}
+		}
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// write logs rec in the background, errors are logged
+func (l *PredictionLog) write(rec PredictionRecord) {
+	go func() {
+		err := l.Write(rec)
+		if err != nil {
+			log.Error("unable to write prediction log ", err)
+		}
+	}()
+}
+
+func (l *PredictionLog) open() error {
+	f, err := os.OpenFile(filepath.Join(l.dir, "predictions.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotate renames the current log and opens a new one, removing the oldest
+// rotated logs beyond maxFiles
+func (l *PredictionLog) rotate() error {
+	err := l.f.Close()
+	if err != nil {
+		return err
+	}
+	name := "predictions-" + time.Now().UTC().Format("20060102T150405.000000000") + ".jsonl"
+	err = os.Rename(filepath.Join(l.dir, "predictions.jsonl"), filepath.Join(l.dir, name))
+	if err != nil {
+		return err
+	}
+
+	rotated, err := filepath.Glob(filepath.Join(l.dir, "predictions-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(rotated) // oldest first
+	for len(rotated) > l.maxFiles {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+
+	return l.open()
+}
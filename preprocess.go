@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// preprocessing operations, see Transform
+const (
+	opRename = "rename"
+	opLog    = "log"
+	opClip   = "clip"
+	opBucket = "bucket"
+	opMerge  = "merge"
+)
+
+// Transform is a single step of the preprocessing applied to every row before
+// the schema, for example:
+//
+//		{"op": "rename", "column": "Age (years)", "to": "age"}
+//		{"op": "log", "column": "income", "offset": 1}
+//		{"op": "clip", "column": "age", "min": 0, "max": 100}
+//		{"op": "bucket", "column": "age", "bounds": [18, 35, 65]}
+//		{"op": "merge", "column": "color", "values": ["teal", "cyan"], "into": "blue"}
+//
+// log, clip, and bucket apply to numbers, leading zeros included whatever the
+// column type, so the training data and predict requests are preprocessed the
+// same way before types are inferred. Other values become missing. log
+// takes the natural log of the value plus offset, values that are not positive
+// become missing. bucket replaces a number with the label of the interval
+// holding it, the intervals are split at bounds and labelled [18, 35) etc.
+// unless labels are given. merge replaces any of values with into.
+type Transform struct {
+	Op     string    `json:"op"`
+	Column string    `json:"column"`
+	To     string    `json:"to,omitempty"`
+	Offset float64   `json:"offset,omitempty"`
+	Min    *float64  `json:"min,omitempty"`
+	Max    *float64  `json:"max,omitempty"`
+	Bounds []float64 `json:"bounds,omitempty"`
+	Labels []string  `json:"labels,omitempty"`
+	Values []string  `json:"values,omitempty"`
+	Into   string    `json:"into,omitempty"`
+}
+
+// validatePreprocess checks each step of s.Preprocess, a SchemaError is returned
+// listing all problems found
+func (s Schema) validatePreprocess() error {
+	var errs SchemaError
+	for i, t := range s.Preprocess {
+		for _, msg := range t.validate() {
+			errs = append(errs, fmt.Sprintf("preprocess step %d: %s", i+1, msg))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (t Transform) validate() []string {
+	var errs []string
+	if t.Column == "" {
+		errs = append(errs, "column is required")
+	}
+
+	switch t.Op {
+	case opRename:
+		if t.To == "" {
+			errs = append(errs, "rename requires to")
+		}
+	case opLog:
+	case opClip:
+		if t.Min == nil && t.Max == nil {
+			errs = append(errs, "clip requires min or max")
+		}
+		if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+			errs = append(errs, "clip min is greater than max")
+		}
+	case opBucket:
+		if len(t.Bounds) == 0 {
+			errs = append(errs, "bucket requires bounds")
+		}
+		for i := 1; i < len(t.Bounds); i++ {
+			if t.Bounds[i] <= t.Bounds[i-1] {
+				errs = append(errs, "bucket bounds should be increasing")
+				break
+			}
+		}
+		if len(t.Labels) > 0 && len(t.Labels) != len(t.Bounds)+1 {
+			errs = append(errs, fmt.Sprintf("bucket requires %d labels, found %d", len(t.Bounds)+1, len(t.Labels)))
+		}
+	case opMerge:
+		if len(t.Values) == 0 || t.Into == "" {
+			errs = append(errs, "merge requires values and into")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown op %q", t.Op))
+	}
+	return errs
+}
+
+// preprocess applies each step of s.Preprocess to row in order
+func (s Schema) preprocess(row map[string]interface{}) {
+	for _, t := range s.Preprocess {
+		raw, ok := row[t.Column]
+		if !ok {
+			continue
+		}
+
+		if t.Op == opRename {
+			delete(row, t.Column)
+			row[t.To] = raw
+			continue
+		}
+		if t.Op == opMerge {
+			if contains(t.Values, categoricalValue(raw)) {
+				row[t.Column] = t.Into
+			}
+			continue
+		}
+
+		num, isNum := s.parseNumber(raw)
+		if !isNum {
+			delete(row, t.Column)
+			continue
+		}
+
+		switch t.Op {
+		case opLog:
+			if num+t.Offset <= 0 {
+				delete(row, t.Column)
+				continue
+			}
+			row[t.Column] = math.Log(num + t.Offset)
+		case opClip:
+			if t.Min != nil && num < *t.Min {
+				num = *t.Min
+			}
+			if t.Max != nil && num > *t.Max {
+				num = *t.Max
+			}
+			row[t.Column] = num
+		case opBucket:
+			row[t.Column] = t.bucket(num)
+		}
+	}
+}
+
+// bucket returns the label of the interval holding num
+func (t Transform) bucket(num float64) string {
+	i := 0
+	for i < len(t.Bounds) && num >= t.Bounds[i] {
+		i++
+	}
+	if len(t.Labels) > 0 {
+		return t.Labels[i]
+	}
+
+	lower, upper := "-inf", "inf"
+	if i > 0 {
+		lower = categoricalValue(t.Bounds[i-1])
+	}
+	if i < len(t.Bounds) {
+		upper = categoricalValue(t.Bounds[i])
+	}
+	return "[" + lower + ", " + upper + ")"
+}
+
+// preprocessFromForm reads the preprocess form field, a JSON array of
+// transforms
+func preprocessFromForm(form map[string][]string) ([]Transform, error) {
+	spec := formValue(form, "preprocess")
+	if spec == "" {
+		return nil, nil
+	}
+
+	var steps []Transform
+	err := json.Unmarshal([]byte(spec), &steps)
+	if err != nil {
+		return nil, SchemaError{fmt.Sprintf("preprocess should be a JSON array of transforms: %v", err)}
+	}
+	return steps, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+// profileTop is the number of most frequent values listed for categorical
+// columns in a DataProfile
+const profileTop = 10
+
+// profileQuantiles are the quantiles listed for numeric columns
+var profileQuantiles = []float64{0.01, 0.05, 0.25, 0.5, 0.75, 0.95, 0.99}
+
+// DataProfile summarizes the training data of a model, it is computed from the
+// statistics gathered by Dataset.Profile and saved in <model_id>.profile.json.
+// Columns are sorted by name and don't include the target, svmlight data has
+// no column profiles.
+type DataProfile struct {
+	Rows    int             `json:"rows"`
+	Columns []ColumnProfile `json:"columns"`
+	Label   ColumnProfile   `json:"label"` // named after the target column, if any
+}
+
+// ColumnProfile summarizes the values of a single column of the training data,
+// Numeric is set for numeric columns and Categorical for categorical columns.
+// Type is the column type from the schema, or ignored for ignored columns.
+// NotImputed is set when an imputation strategy was requested but found no
+// value to fill the column with, e.g. most_frequent for a column without a
+// frequent value, its missing values are left out of the rows.
+type ColumnProfile struct {
+	Name        string              `json:"name"`
+	Type        string              `json:"type"`
+	Missing     int                 `json:"missing"`
+	MissingRate float64             `json:"missing_rate"`
+	Distinct    int                 `json:"distinct"`
+	Exact       bool                `json:"distinct_exact"` // false when there are more than Distinct values
+	NotImputed  bool                `json:"not_imputed,omitempty"`
+	Numeric     *NumericProfile     `json:"numeric,omitempty"`
+	Categorical *CategoricalProfile `json:"categorical,omitempty"`
+}
+
+// NumericProfile summarizes a numeric column, quantiles are approximate for
+// large datasets and keyed by quantile, e.g. "0.5" for the median
+type NumericProfile struct {
+	Min       float64            `json:"min"`
+	Max       float64            `json:"max"`
+	Mean      float64            `json:"mean"`
+	Std       float64            `json:"std"`
+	Quantiles map[string]float64 `json:"quantiles"`
+}
+
+// CategoricalProfile lists the most frequent values of a categorical column,
+// counts are exact unless the column has more than frequentCapacity distinct
+// values, then they are lower bounds
+type CategoricalProfile struct {
+	Top []valueCount `json:"top"`
+}
+
+// DataProfile returns the profile of a dataset, it should be called after
+// Profile
+func (ds *Dataset) DataProfile() DataProfile {
+	s := ds.Schema
+	p := DataProfile{Rows: ds.Rows, Columns: []ColumnProfile{}}
+
+	ignored := make(map[string]bool)
+	for _, col := range s.Ignore {
+		ignored[col] = true
+	}
+	for _, col := range ds.columns {
+		if col == s.Target {
+			continue
+		}
+		typ := s.Types[col]
+		if ignored[col] {
+			typ = "ignored"
+		}
+		c := profileColumn(ds.Rows, col, typ, ds.stats[col], profileTop)
+		if _, filled := s.Fill[col]; s.Impute != "" && !filled && !ignored[col] && typ != typeText {
+			c.NotImputed = true
+		}
+		p.Columns = append(p.Columns, c)
+	}
+
+	if labels := ds.labelStats(); labels != nil {
+		typ := typeCategorical
+		if ds.isRegression {
+			typ = typeNumeric
+		}
+		name := s.Target
+		if name == "" {
+			name = "label"
+		}
+		// the counts of every label, numeric labels are classes as well
+		p.Label = profileColumn(ds.Rows, name, typ, labels, frequentCapacity)
+		p.Label.Categorical = &CategoricalProfile{labels.frequent.top(frequentCapacity)}
+	}
+
+	return p
+}
+
+// profileColumn summarizes the statistics of a column, listing the top most
+// frequent values of categorical columns
+func profileColumn(rows int, name, typ string, c *columnStats, top int) ColumnProfile {
+	p := ColumnProfile{
+		Name:     name,
+		Type:     typ,
+		Missing:  rows - c.count,
+		Distinct: c.distinct(),
+		Exact:    c.exactDistinct(),
+	}
+	if rows > 0 {
+		p.MissingRate = float64(p.Missing) / float64(rows)
+	}
+
+	switch typ {
+	case typeNumeric:
+		if c.numeric == 0 {
+			break
+		}
+		n := float64(c.numeric)
+		mean := c.sum / n
+		p.Numeric = &NumericProfile{
+			Min:       c.quantiles.min,
+			Max:       c.quantiles.max,
+			Mean:      mean,
+			Std:       math.Sqrt(math.Max(c.sumSq/n-mean*mean, 0)),
+			Quantiles: make(map[string]float64),
+		}
+		for _, q := range profileQuantiles {
+			p.Numeric.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = c.quantiles.quantile(q)
+		}
+	case typeCategorical:
+		p.Categorical = &CategoricalProfile{c.frequent.top(top)}
+	}
+	return p
+}
+
+// Profile returns the profile of the model's training data, an error satisfying
+// os.IsNotExist is returned for models fit without one
+func (m *Model) Profile() (DataProfile, error) {
+	var p DataProfile
+	err := readJSONFile(filepath.Join(m.dir, m.ID+".profile.json"), &p)
+	return p, err
+}
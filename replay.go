@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// runReplay implements the replay command, re-sending the predict requests
+// captured in prediction logs and comparing the new predictions to the logged
+// ones:
+//
+// 	$ mlserver replay -server http://localhost:5000 -model <model_id> predictions.jsonl ...
+//
+// Each record is sent to the model given by -model, or the model it was logged
+// for, as a JSON predict request. Rows whose most likely label changed are
+// printed along with the largest change in any class probability, followed by
+// a summary of all rows. Redacted values are sent as logged.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:5000", "address of the mlserver to replay requests against")
+	model := fs.String("model", "", "model to replay requests against, defaults to the model of each logged request")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: mlserver replay [-server <address>] [-model <model_id>] <prediction log>...")
+	}
+
+	r := &replayer{server: strings.TrimSuffix(*server, "/"), model: *model, out: os.Stdout}
+	for _, path := range fs.Args() {
+		err := readPredictionLog(path, r.replay)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	r.summary()
+	return nil
+}
+
+// replayer re-sends logged predict requests, keeping totals for the summary
+type replayer struct {
+	server string
+	model  string
+	out    io.Writer
+
+	requests int
+	rows     int
+	changed  int     // rows with a different most likely label
+	sumDiff  float64 // sum of the largest probability change of each row
+	maxDiff  float64
+}
+
+func (r *replayer) replay(rec PredictionRecord) error {
+	modelID := r.model
+	if modelID == "" {
+		modelID = rec.ModelID
+	}
+
+	body, err := json.Marshal(ModelReq{Data: rec.Data})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(r.server+"/models/"+modelID, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("request %s: %s: %s", rec.RequestID, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var pred Prediction
+	err = json.NewDecoder(resp.Body).Decode(&pred)
+	if err != nil {
+		return err
+	}
+	if len(pred.Labels) != len(rec.Labels) {
+		return fmt.Errorf("request %s: logged %d predictions, replay returned %d", rec.RequestID, len(rec.Labels), len(pred.Labels))
+	}
+
+	r.requests++
+	for i, logged := range rec.Labels {
+		diff := maxProbDiff(logged, pred.Labels[i])
+		r.rows++
+		r.sumDiff += diff
+		r.maxDiff = math.Max(r.maxDiff, diff)
+
+		before, after := mostLikely(logged), mostLikely(pred.Labels[i])
+		if before != after {
+			r.changed++
+			fmt.Fprintf(r.out, "%s row %d: %s -> %s (max probability change %.4f)\n", rec.RequestID, i, before, after, diff)
+		}
+	}
+	return nil
+}
+
+func (r *replayer) summary() {
+	var mean float64
+	if r.rows > 0 {
+		mean = r.sumDiff / float64(r.rows)
+	}
+	fmt.Fprintf(r.out, "replayed %d requests, %d rows: %d labels changed, mean max probability change %.4f, largest %.4f\n",
+		r.requests, r.rows, r.changed, mean, r.maxDiff)
+}
+
+// maxProbDiff returns the largest difference between the probabilities of a
+// class, classes missing from either prediction have probability 0
+func maxProbDiff(a, b map[string]float64) float64 {
+	var diff float64
+	for class, p := range a {
+		diff = math.Max(diff, math.Abs(p-b[class]))
+	}
+	for class, p := range b {
+		diff = math.Max(diff, math.Abs(p-a[class]))
+	}
+	return diff
+}
+
+// readPredictionLog calls fn for each record in the prediction log file at path
+func readPredictionLog(path string, fn func(rec PredictionRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec PredictionRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// payload hashes of signed requests, the body of uploads is not hashed
+const (
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// s3Storage keeps models in an S3 bucket, or a service implementing the S3 API,
+// as objects <prefix><model_id>/<name>. Requests are signed with AWS signature
+// version 4 and addressed path style, <endpoint>/<bucket>/<key>, as most S3
+// compatible services expect, the endpoint may include a path.
+type s3Storage struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string // empty or ending in /
+	region   string
+	client   *http.Client
+
+	accessKey    string
+	secretKey    string
+	sessionToken string // only set for temporary credentials
+}
+
+// newS3Storage returns storage for the bucket and prefix of an s3://bucket/prefix
+// url, credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// and AWS_SESSION_TOKEN environment variables
+func newS3Storage(location, endpoint, region string) (*s3Storage, error) {
+	loc, err := url.Parse(location)
+	if err != nil || loc.Scheme != "s3" || loc.Host == "" {
+		return nil, fmt.Errorf("mlserver: storage %q should be s3://<bucket>/<prefix>", location)
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil || (ep.Scheme != "http" && ep.Scheme != "https") || ep.Host == "" {
+		return nil, fmt.Errorf("mlserver: s3 endpoint %q should be an http or https url", endpoint)
+	}
+
+	s := &s3Storage{
+		endpoint:     ep,
+		bucket:       loc.Host,
+		prefix:       strings.Trim(loc.Path, "/"),
+		region:       region,
+		client:       &http.Client{},
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("mlserver: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY should be set for s3 storage")
+	}
+	return s, nil
+}
+
+func (s *s3Storage) key(id, name string) string {
+	return s.prefix + id + "/" + name
+}
+
+func (s *s3Storage) List() ([]string, error) {
+	var ids []string
+	err := s.list(s.prefix, "/", func(r listBucketResult) {
+		for _, p := range r.CommonPrefixes {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(p.Prefix, s.prefix), "/"))
+		}
+	})
+	return ids, err
+}
+
+func (s *s3Storage) Metadata(id string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.key(id, id+".json"), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrModelNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3ResponseError(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Artifacts(id string) ([]string, error) {
+	prefix := s.key(id, "")
+	var names []string
+	err := s.list(prefix, "", func(r listBucketResult) {
+		for _, obj := range r.Contents {
+			names = append(names, strings.TrimPrefix(obj.Key, prefix))
+		}
+	})
+	return names, err
+}
+
+func (s *s3Storage) Fetch(id, name, path string) error {
+	key := s.key(id, name)
+	resp, err := s.do("GET", key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: "fetch", Path: "s3://" + s.bucket + "/" + key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(resp)
+	}
+	return writeFileFrom(path, resp.Body)
+}
+
+func (s *s3Storage) Put(id, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("PUT", s.key(id, name), nil, f, fi.Size())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) Remove(id, name string) error {
+	resp, err := s.do("DELETE", s.key(id, name), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3ResponseError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is a page of a ListObjectsV2 response
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list calls fn with each page of the objects under prefix, objects below the
+// next delimiter are grouped into CommonPrefixes unless delimiter is empty
+func (s *s3Storage) list(prefix, delimiter string, fn func(listBucketResult)) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+
+	for {
+		resp, err := s.do("GET", "", query, nil, 0)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3ResponseError(resp)
+		}
+
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		fn(page)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for the object key of the bucket, or the bucket
+// when key is empty, body is nil unless uploading size bytes
+func (s *s3Storage) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	path := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket + "/" + key
+	if size == 0 {
+		body = nil // an empty body would be sent chunked
+	}
+
+	req, err := http.NewRequest(method, s.endpoint.Scheme+"://"+s.endpoint.Host+"/", body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Opaque = awsURIEncode(path, false)
+	req.URL.RawQuery = canonicalQuery(query)
+	req.ContentLength = size
+
+	payload := emptyPayload
+	if body != nil {
+		payload = unsignedPayload
+	}
+	s.sign(req, payload, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds an AWS signature version 4 Authorization header to the request,
+// req.URL.Opaque should hold the encoded path
+func (s *s3Storage) sign(req *http.Request, payload string, t time.Time) {
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// the host and x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, vals := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(vals, ","))
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var canonical bytes.Buffer
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.Opaque, req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payload)
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256(canonical.Bytes())
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by name, as signed
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, val := range query[name] {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(val, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// awsURIEncode percent encodes every byte but the unreserved characters of RFC
+// 3986, slashes are kept unless encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3ResponseError returns an error describing a failed request and closes the
+// response body
+func s3ResponseError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	var e struct {
+		Code    string
+		Message string
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if xml.Unmarshal(b, &e) != nil || e.Code == "" {
+		return fmt.Errorf("mlserver: s3 %s %s: %s", resp.Request.Method, resp.Request.URL.Opaque, resp.Status)
+	}
+	return fmt.Errorf("mlserver: s3 %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Opaque, e.Code, e.Message)
+}
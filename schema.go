@@ -0,0 +1,517 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// column types, see Schema.Types
+const (
+	typeNumeric     = "numeric"
+	typeCategorical = "categorical"
+	typeDatetime    = "datetime"
+	typeText        = "text"
+)
+
+// defaultTextMaxFeatures is the default vocabulary size limit for text columns
+const defaultTextMaxFeatures = 10000
+
+// defaultNA lists the values treated as missing when a fit request does not
+// supply its own list. Empty cells and JSON nulls are always missing.
+var defaultNA = []string{"NA", "N/A", "n/a", "na", "NaN", "nan", "null", "NULL", "None", "?"}
+
+// Schema describes how the columns of the data supplied with a fit request
+// should be interpreted. The schema is resolved against the training data by
+// Fit and saved with the model, predict requests for the model are parsed
+// using the same schema.
+type Schema struct {
+	// Target is the column holding the label, for csv uploads this defaults
+	// to the first column.
+	Target string `json:"target,omitempty"`
+	// Ignore lists columns that should not be used as features.
+	Ignore []string `json:"ignore,omitempty"`
+	// Categorical lists columns that should be treated as categorical even
+	// when the values look numeric, e.g. zip codes.
+	Categorical []string `json:"categorical,omitempty"`
+	// Text lists columns holding free text, they are tokenized and weighted by
+	// TF-IDF in the fitted pipeline. Text columns are never inferred.
+	Text []string `json:"text,omitempty"`
+	// TextMaxFeatures limits the vocabulary kept for each text column to the
+	// most frequent terms, defaults to defaultTextMaxFeatures.
+	TextMaxFeatures int `json:"text_max_features,omitempty"`
+	// Types maps column names to "numeric", "categorical", "datetime", or
+	// "text". Columns without an entry are inferred from all values in the
+	// training data, after Fit every feature column has an entry. Datetime
+	// columns are expanded into numeric features, see expandTime.
+	Types map[string]string `json:"types,omitempty"`
+	// NA lists the values treated as missing, defaults to defaultNA.
+	NA []string `json:"na,omitempty"`
+	// Impute is the strategy used to fill in missing values, see imputeValue.
+	// When empty, missing values are left out of the row.
+	Impute string `json:"impute,omitempty"`
+	// FillValue is used by the constant imputation strategy.
+	FillValue interface{} `json:"fill_value,omitempty"`
+	// Fill holds the value used to fill in each column, computed by Fit.
+	Fill map[string]interface{} `json:"fill,omitempty"`
+	// Preprocess lists the transforms applied in order to every row, after
+	// nested values are flattened and before the rest of the schema.
+	Preprocess []Transform `json:"preprocess,omitempty"`
+	// Flatten describes how nested objects and arrays in JSON rows are turned
+	// into columns.
+	Flatten Flatten `json:"flatten"`
+	// Dialect is the format of delimited text data.
+	Dialect Dialect `json:"dialect"`
+	// Sparse is true for models fit on svmlight data. Every feature is numeric
+	// and missing features are zero, so no per column types, statistics, or
+	// fill values are kept.
+	Sparse bool `json:"sparse,omitempty"`
+
+	// keepInput asks Apply to keep a copy of the rows as received, see
+	// ModelReq.input
+	keepInput bool
+	// drift, if not nil, counts the values of each row, see driftMonitor
+	drift *driftMonitor
+}
+
+// SchemaError lists the problems found when checking a Schema against the
+// columns present in the data.
+type SchemaError []string
+
+func (e SchemaError) Error() string {
+	return "mlserver: invalid schema: " + strings.Join(e, "; ")
+}
+
+func (s Schema) isIgnored(col string) bool {
+	return contains(s.Ignore, col)
+}
+
+func (s Schema) isCategorical(col string) bool {
+	return contains(s.Categorical, col)
+}
+
+// isNA reports if a raw string value should be treated as missing
+func (s Schema) isNA(val string) bool {
+	val = strings.TrimSpace(val)
+	return val == "" || contains(s.NA, val)
+}
+
+// Validate checks that every column named in the schema is present in columns
+// and that the column types and imputation strategy are known, a SchemaError is
+// returned listing all problems found.
+func (s Schema) Validate(columns []string) error {
+	var errs SchemaError
+
+	if s.Target != "" && !contains(columns, s.Target) {
+		errs = append(errs, fmt.Sprintf("unknown target column %q", s.Target))
+	}
+	for _, col := range s.Ignore {
+		if !contains(columns, col) {
+			errs = append(errs, fmt.Sprintf("unknown ignore column %q", col))
+		}
+		if col == s.Target {
+			errs = append(errs, fmt.Sprintf("target column %q can't be ignored", col))
+		}
+	}
+	for _, col := range s.Categorical {
+		if !contains(columns, col) {
+			errs = append(errs, fmt.Sprintf("unknown categorical column %q", col))
+		}
+	}
+	for _, col := range s.Text {
+		if !contains(columns, col) {
+			errs = append(errs, fmt.Sprintf("unknown text column %q", col))
+		}
+		if s.isCategorical(col) {
+			errs = append(errs, fmt.Sprintf("column %q can't be both text and categorical", col))
+		}
+	}
+	if s.TextMaxFeatures < 0 {
+		errs = append(errs, fmt.Sprintf("text_max_features %d should be positive", s.TextMaxFeatures))
+	}
+	for col, typ := range s.Types {
+		if !contains(columns, col) {
+			errs = append(errs, fmt.Sprintf("unknown column %q in types", col))
+		}
+		if typ != typeNumeric && typ != typeCategorical && typ != typeDatetime && typ != typeText {
+			errs = append(errs, fmt.Sprintf("unknown type %q for column %q", typ, col))
+		}
+		if typ != typeCategorical && s.isCategorical(col) {
+			errs = append(errs, fmt.Sprintf("column %q can't be both %s and categorical", col, typ))
+		}
+		if typ != typeText && contains(s.Text, col) {
+			errs = append(errs, fmt.Sprintf("column %q can't be both %s and text", col, typ))
+		}
+	}
+	if s.Impute != "" && !contains(imputeStrategies, s.Impute) {
+		errs = append(errs, fmt.Sprintf("unknown imputation strategy %q", s.Impute))
+	}
+	errs = append(errs, s.Flatten.validate()...)
+
+	if len(errs) > 0 {
+		sort.Strings(errs) // types are checked in map order
+		return errs
+	}
+	return nil
+}
+
+// Fit resolves the schema against the statistics gathered by Dataset.Profile.
+// The type of every feature column is inferred from all of its values and the
+// fill values for the imputation strategy are computed. A SchemaError is
+// returned when the schema names unknown columns, labels are missing, or a
+// column declared numeric holds values that can't be parsed as numbers.
+func (s *Schema) Fit(ds *Dataset) error {
+	if s.Sparse {
+		return s.fitSparse(ds)
+	}
+
+	err := s.Validate(ds.columns)
+	if err != nil {
+		return err
+	}
+
+	if s.Target != "" && ds.labels != nil {
+		return SchemaError{"labels can't be supplied along with a target column"}
+	}
+	labels := ds.labelStats()
+	if labels == nil {
+		return SchemaError{"labels or a target column must be supplied"}
+	}
+	if missing := ds.Rows - labels.count; missing > 0 {
+		return SchemaError{fmt.Sprintf("%d rows are missing a label", missing)}
+	}
+
+	err = s.inferTypes(ds)
+	if err != nil {
+		return err
+	}
+
+	return s.fitImputer(ds)
+}
+
+// fitSparse checks the schema of svmlight data, the labels are always the first
+// field of each line and the column options don't apply
+func (s *Schema) fitSparse(ds *Dataset) error {
+	var errs SchemaError
+	if s.Target != "" || len(s.Ignore) > 0 || len(s.Categorical) > 0 || len(s.Types) > 0 {
+		errs = append(errs, "target, ignore, categorical, and types can't be used with svmlight data")
+	}
+	if s.Impute != "" {
+		errs = append(errs, "missing svmlight features are zero, impute can't be used")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	s.Types, s.Fill = nil, nil
+	return nil
+}
+
+// isSparse reports if the features passed to the model are sparse, either
+// svmlight data or data with text columns
+func (s Schema) isSparse() bool {
+	for _, typ := range s.Types {
+		if typ == typeText {
+			return true
+		}
+	}
+	return s.Sparse
+}
+
+// Apply transforms the rows of a predict request the same way the training
+// data was transformed: nested values are flattened, the preprocessing steps
+// are applied, then the rest of the schema, see applyRow. The rows as received
+// are copied to d.input first when s.keepInput is set, and counted by s.drift
+// before the schema is applied.
+func (s Schema) Apply(d *ModelReq) {
+	if s.keepInput {
+		d.input = make([]map[string]interface{}, len(d.Data))
+		for i, row := range d.Data {
+			d.input[i] = make(map[string]interface{}, len(row))
+			for col, val := range row {
+				d.input[i][col] = val
+			}
+		}
+	}
+	for _, row := range d.Data {
+		s.Flatten.apply(row, nil)
+		s.preprocess(row)
+		s.drift.observe(row)
+		s.applyRow(row)
+	}
+}
+
+// applyRow drops the target and ignored columns, converts values to the column
+// types found by Fit, and fills in missing values. Values that don't match the
+// column type are treated as missing, columns that were not present in the
+// training data are converted value by value. Datetime columns are expanded
+// last, so filled in timestamps are expanded as well.
+func (s Schema) applyRow(row map[string]interface{}) {
+	if s.Target != "" {
+		delete(row, s.Target)
+	}
+	for _, col := range s.Ignore {
+		delete(row, col)
+	}
+
+	for col, raw := range row {
+		val, ok := s.parseColumn(col, raw)
+		if !ok {
+			delete(row, col)
+			continue
+		}
+
+		switch s.Types[col] {
+		case typeNumeric:
+			if _, isNum := val.(float64); !isNum {
+				delete(row, col)
+				continue
+			}
+		case typeCategorical, typeText:
+			val = categoricalValue(raw)
+		case typeDatetime:
+			if _, isTime := parseTime(raw); !isTime {
+				delete(row, col)
+				continue
+			}
+		}
+		row[col] = val
+	}
+
+	for col, val := range s.Fill {
+		if _, ok := row[col]; !ok {
+			row[col] = val
+		}
+	}
+
+	for col, typ := range s.Types {
+		if typ == typeDatetime {
+			expandTime(row, col)
+		}
+	}
+}
+
+// inferTypes sets the type of each feature column that does not already have
+// one. Columns listed in s.Categorical or s.Text are categorical or text,
+// otherwise columns holding only numbers are numeric, columns holding only dates
+// or timestamps are datetime, and all others are categorical.
+func (s *Schema) inferTypes(ds *Dataset) error {
+	types := make(map[string]string)
+	for col, typ := range s.Types {
+		types[col] = typ
+	}
+	for _, col := range s.Categorical {
+		types[col] = typeCategorical
+	}
+	for _, col := range s.Text {
+		types[col] = typeText
+	}
+
+	var errs SchemaError
+	for _, col := range ds.columns {
+		if col == s.Target || s.isIgnored(col) {
+			continue
+		}
+
+		stats := ds.stats[col]
+		switch types[col] {
+		case typeCategorical, typeText:
+		case typeNumeric:
+			if !stats.isNumeric() {
+				errs = append(errs, fmt.Sprintf("numeric column %q has value %q", col, stats.example))
+			}
+		case typeDatetime:
+			if !stats.isDatetime() {
+				errs = append(errs, fmt.Sprintf("datetime column %q has value %q", col, stats.notTime))
+			}
+		default:
+			switch {
+			case stats.isNumeric():
+				types[col] = typeNumeric
+			case stats.isDatetime():
+				types[col] = typeDatetime
+			default:
+				types[col] = typeCategorical
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	delete(types, s.Target)
+	for _, col := range s.Ignore {
+		delete(types, col)
+	}
+	s.Types = types
+
+	for _, typ := range types {
+		if typ == typeText && s.TextMaxFeatures == 0 {
+			s.TextMaxFeatures = defaultTextMaxFeatures
+		}
+	}
+	return nil
+}
+
+// parseCell converts a raw csv or JSON value to a float64 or string, the second
+// return value is false when the value is missing. Strings are numeric when they
+// parse as a finite float and don't have a leading zero, values like "02134" are
+// usually identifiers rather than quantities.
+func (s Schema) parseCell(raw interface{}) (interface{}, bool) {
+	switch val := raw.(type) {
+	case nil:
+		return nil, false
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil, false
+		}
+		return val, true
+	case string:
+		if s.isNA(val) {
+			return nil, false
+		}
+		trimmed := strings.TrimSpace(val)
+		if hasLeadingZero(trimmed) {
+			return val, true
+		}
+		num, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+			return val, true
+		}
+		return num, true
+	default:
+		return categoricalValue(raw), true
+	}
+}
+
+// parseColumn is parseCell for a value of column col, the leading zero rule
+// only applies while column types are inferred, values like "02134" are
+// numbers in columns of type numeric
+func (s Schema) parseColumn(col string, raw interface{}) (interface{}, bool) {
+	if s.Types[col] == typeNumeric {
+		if num, ok := s.parseNumber(raw); ok {
+			return num, true
+		}
+	}
+	return s.parseCell(raw)
+}
+
+// parseNumber returns the number held by a raw value, including numbers with
+// leading zeros, false is returned for missing values and other values
+func (s Schema) parseNumber(raw interface{}) (float64, bool) {
+	val, ok := s.parseCell(raw)
+	if str, isStr := val.(string); isStr {
+		num, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		return num, err == nil && !math.IsNaN(num) && !math.IsInf(num, 0)
+	}
+	num, isNum := val.(float64)
+	return num, ok && isNum
+}
+
+// categoricalValue formats a raw value as a string
+func categoricalValue(raw interface{}) string {
+	switch val := raw.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(raw)
+	}
+}
+
+func hasLeadingZero(val string) bool {
+	return len(val) > 1 && val[0] == '0' && val[1] >= '0' && val[1] <= '9'
+}
+
+// schemaFromForm reads the schema fields from a multipart form. The ignore,
+// categorical, text, and na fields may be repeated or hold a comma separated
+// list, types is a list of column:type pairs. See flattenFromForm for the
+// flatten options and preprocessFromForm for the preprocess field.
+func schemaFromForm(form map[string][]string) (Schema, error) {
+	s := Schema{
+		Target:      formValue(form, "target"),
+		Ignore:      splitFormList(form["ignore"]),
+		Categorical: splitFormList(form["categorical"]),
+		Text:        splitFormList(form["text"]),
+		NA:          splitFormList(form["na"]),
+		Impute:      formValue(form, "impute"),
+		Flatten:     flattenFromForm(form),
+	}
+
+	if limit := formValue(form, "text_max_features"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return Schema{}, SchemaError{fmt.Sprintf("text_max_features %q should be a number", limit)}
+		}
+		s.TextMaxFeatures = n
+	}
+
+	if fill := formValue(form, "fill_value"); fill != "" {
+		s.FillValue = fill
+	}
+
+	var err error
+	s.Preprocess, err = preprocessFromForm(form)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	for _, pair := range splitFormList(form["types"]) {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return Schema{}, SchemaError{fmt.Sprintf("types entry %q should be column:type", pair)}
+		}
+		if s.Types == nil {
+			s.Types = make(map[string]string)
+		}
+		s.Types[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return s, nil
+}
+
+func formValue(form map[string][]string, key string) string {
+	return strings.TrimSpace(strings.Join(form[key], ""))
+}
+
+func splitFormList(vals []string) []string {
+	var list []string
+	for _, val := range vals {
+		for _, item := range strings.Split(val, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// columnNames returns the sorted set of keys used across all rows
+func columnNames(rows []map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, row := range rows {
+		for name := range row {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// profileCSV spools csv data and profiles it with the schema, the caller
+// removes the returned dataset
+func profileCSV(t *testing.T, data string, s Schema) *Dataset {
+	ds, err := SpoolCSV(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Schema = s
+	err = ds.Profile()
+	if err != nil {
+		ds.Remove()
+		t.Fatal(err)
+	}
+	return ds
+}
+
+// predictCSV parses csv data the way a predict request is parsed
+func predictCSV(t *testing.T, data string, s Schema) []map[string]interface{} {
+	d, err := ParseCSV(strings.NewReader(data), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Data
+}
+
+func TestInferTypes(t *testing.T) {
+	data := "label,num,zip,day,color,mixed,id\n" +
+		"a,1,02134,2014-03-02,red,1,7\n" +
+		"b,2.5,10001,2014-03-03 10:30:00,blue,x,8\n" +
+		"a,,02139,,NA,3,9\n"
+	ds := profileCSV(t, data, Schema{Target: "label", Categorical: []string{"id"}})
+	defer ds.Remove()
+
+	want := map[string]string{
+		"num":   typeNumeric,
+		"zip":   typeCategorical, // leading zeros are identifiers
+		"day":   typeDatetime,
+		"color": typeCategorical,
+		"mixed": typeCategorical,
+		"id":    typeCategorical,
+	}
+	if !reflect.DeepEqual(ds.Schema.Types, want) {
+		t.Errorf("types %v, want %v", ds.Schema.Types, want)
+	}
+}
+
+func TestDeclaredNumericLeadingZero(t *testing.T) {
+	data := "label,zip\na,02134\nb,10001\n"
+
+	ds := profileCSV(t, data, Schema{Target: "label", Types: map[string]string{"zip": typeNumeric}})
+	defer ds.Remove()
+	if typ := ds.Schema.Types["zip"]; typ != typeNumeric {
+		t.Fatalf("zip is %s, want numeric", typ)
+	}
+	rows := predictCSV(t, "zip\n0456\n", ds.Schema)
+	if rows[0]["zip"] != 456.0 {
+		t.Errorf("declared numeric zip = %#v, want 456", rows[0]["zip"])
+	}
+
+	inferred := profileCSV(t, data, Schema{Target: "label"})
+	defer inferred.Remove()
+	rows = predictCSV(t, "zip\n0456\n", inferred.Schema)
+	if rows[0]["zip"] != "0456" {
+		t.Errorf("inferred categorical zip = %#v, want \"0456\"", rows[0]["zip"])
+	}
+}
+
+func TestPreprocessLeadingZero(t *testing.T) {
+	s := Schema{Target: "label", Preprocess: []Transform{{Op: opLog, Column: "zip", Offset: 1}}}
+	ds := profileCSV(t, "label,zip\na,0123\nb,5\n", s)
+	defer ds.Remove()
+
+	if typ := ds.Schema.Types["zip"]; typ != typeNumeric {
+		t.Fatalf("zip is %s, want numeric", typ)
+	}
+	if n := ds.stats["zip"].numeric; n != 2 {
+		t.Errorf("profiled %d numbers, want 2", n)
+	}
+	train, err := ds.Labeled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := predictCSV(t, "zip\n0123\n", ds.Schema)
+
+	want := math.Log(124)
+	if train.Data[0]["zip"] != want || rows[0]["zip"] != want {
+		t.Errorf("log(0123 + 1) is %v when fitting and %v when predicting, want %v", train.Data[0]["zip"], rows[0]["zip"], want)
+	}
+}
+
+func TestImpute(t *testing.T) {
+	data := "label,x,c\na,1,red\nb,2,red\na,,\nb,9,blue\na,,red\n"
+	tests := []struct {
+		impute string
+		fill   map[string]interface{}
+	}{
+		{"", nil},
+		{"mean", map[string]interface{}{"x": 4.0, "c": "red"}},
+		{"median", map[string]interface{}{"x": 2.0, "c": "red"}},
+		{"most_frequent", map[string]interface{}{"x": 1.0, "c": "red"}},
+		{"constant", map[string]interface{}{"x": 0.0, "c": "missing"}},
+	}
+
+	for _, tt := range tests {
+		ds := profileCSV(t, data, Schema{Target: "label", Impute: tt.impute})
+		ds.Remove()
+		if !reflect.DeepEqual(ds.Schema.Fill, tt.fill) {
+			t.Errorf("impute %q: fill %v, want %v", tt.impute, ds.Schema.Fill, tt.fill)
+		}
+	}
+
+	ds := profileCSV(t, data, Schema{Target: "label", Impute: "mean"})
+	defer ds.Remove()
+	rows := predictCSV(t, "x,c\n,\n", ds.Schema)
+	want := map[string]interface{}{"x": 4.0, "c": "red"}
+	if !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("filled row %v, want %v", rows[0], want)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	tests := []struct {
+		schema Schema
+		err    string
+	}{
+		{Schema{Target: "nope"}, `"nope"`},
+		{Schema{Target: "label", Types: map[string]string{"c": typeNumeric}}, `numeric column "c" has value "red"`},
+		{Schema{Target: "label", Impute: "mode"}, `unknown imputation strategy "mode"`},
+	}
+
+	for _, tt := range tests {
+		ds, err := SpoolCSV(strings.NewReader("label,x,c\na,1,red\nb,,blue\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.Schema = tt.schema
+		err = ds.Profile()
+		ds.Remove()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: error %v, want %q", tt.schema, err, tt.err)
+		}
+	}
+}
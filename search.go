@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// search strategies, see Search.Strategy
+const (
+	searchGrid   = "grid"
+	searchRandom = "random"
+)
+
+const (
+	defaultFolds      = 3
+	maxFolds          = 20
+	defaultIterations = 10
+	maxIterations     = 200
+	maxCandidates     = 500 // parameter combinations tried by a grid search
+)
+
+// Search describes the model selection done by fit.py. Each candidate algorithm
+// is tuned by a cross validated grid or random search over its parameters, the
+// algorithm and parameters with the best score are refit on all of the data.
+//
+//		{
+//			"algorithms": [
+//				{"name": "LogisticRegression", "params": {"C": [0.1, 1, 10]}},
+//				{"name": "RandomForestClassifier", "params": {
+//					"n_estimators": [100, 300],
+//					"max_depth": {"distribution": "randint", "low": 2, "high": 20}
+//				}}
+//			],
+//			"strategy": "random",
+//			"iterations": 20,
+//			"folds": 5,
+//			"scoring": "f1_macro"
+//		}
+//
+// Parameters are either a list of values or, for random searches over numeric
+// parameters, a distribution: uniform, loguniform, or randint between low and
+// high.
+type Search struct {
+	Algorithms []Algorithm `json:"algorithms,omitempty"`
+	Strategy   string      `json:"strategy,omitempty"`   // grid (the default) or random
+	Iterations int         `json:"iterations,omitempty"` // parameter settings sampled by a random search
+	Folds      int         `json:"folds,omitempty"`      // cross validation folds
+	Scoring    string      `json:"scoring,omitempty"`    // metric used to rank the candidates, see scoringMetrics
+}
+
+// Algorithm is a candidate estimator and the values to search for each of its
+// parameters, parameters not listed keep the sklearn defaults
+type Algorithm struct {
+	Name   string                     `json:"name"`
+	Params map[string]json.RawMessage `json:"params,omitempty"`
+}
+
+// Distribution is sampled by a random search
+type Distribution struct {
+	Distribution string  `json:"distribution"`
+	Low          float64 `json:"low"`
+	High         float64 `json:"high"`
+}
+
+// tasks, see metricSpec
+const (
+	taskClassification = "classification"
+	taskRegression     = "regression"
+)
+
+const defaultScoring = "accuracy"
+
+type metricSpec struct {
+	task   string
+	binary bool // only defined for two classes
+}
+
+// scoringMetrics lists the metrics that can be used to rank the candidates of a
+// model search, log_loss is better when lower. The models fit by mlserver are
+// all classifiers, the regression metrics are known so that requesting them
+// is reported as unsupported rather than unknown.
+var scoringMetrics = map[string]metricSpec{
+	"accuracy":          {task: taskClassification},
+	"balanced_accuracy": {task: taskClassification},
+	"f1_macro":          {task: taskClassification},
+	"f1_weighted":       {task: taskClassification},
+	"roc_auc":           {task: taskClassification, binary: true},
+	"log_loss":          {task: taskClassification},
+	"r2":                {task: taskRegression},
+	"rmse":              {task: taskRegression},
+}
+
+// checkScoring returns a description of the problem with the scoring metric for
+// labels with the given number of classes, the empty string is returned when
+// the metric can be used
+func checkScoring(scoring string, classes int) string {
+	metric, ok := scoringMetrics[scoring]
+	if !ok {
+		var names []string
+		for name := range scoringMetrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Sprintf("unknown scoring %q, use one of %s", scoring, strings.Join(names, ", "))
+	}
+	if metric.task != taskClassification {
+		return fmt.Sprintf("scoring %s is for %s, only classification models are supported", scoring, metric.task)
+	}
+	if metric.binary && classes != 2 {
+		return fmt.Sprintf("scoring %s requires 2 classes, found %d", scoring, classes)
+	}
+	return ""
+}
+
+// SearchError lists the problems found when checking a Search against the
+// allowed algorithms
+type SearchError []string
+
+func (e SearchError) Error() string {
+	return "mlserver: invalid search: " + strings.Join(e, "; ")
+}
+
+// parameter types
+const (
+	paramInt    = "int"
+	paramFloat  = "float"
+	paramBool   = "bool"
+	paramString = "string"
+	paramNumber = "number" // int, float, or one of the choices, e.g. max_features
+)
+
+type paramSpec struct {
+	typ     string
+	choices []string // allowed string values
+}
+
+type algorithmSpec struct {
+	sparse   bool // accepts sparse input
+	params   map[string]paramSpec
+	defaults map[string]json.RawMessage // values searched for parameters not listed
+}
+
+// algorithms is the allow-list of estimators that can be named in a fit
+// request along with the parameters that can be searched, the -algorithms flag
+// can restrict it further. Every estimator must support predict_proba, when the
+// sklearn default of a parameter doesn't, e.g. the hinge loss of
+// SGDClassifier, the spec's defaults replace it.
+var algorithms = map[string]algorithmSpec{
+	"LogisticRegression": {sparse: true, params: map[string]paramSpec{
+		"C":             {typ: paramFloat},
+		"penalty":       {typ: paramString, choices: []string{"l1", "l2"}},
+		"fit_intercept": {typ: paramBool},
+		"class_weight":  {typ: paramString, choices: []string{"auto", "balanced"}},
+	}},
+	"SGDClassifier": {sparse: true, params: map[string]paramSpec{
+		"loss":    {typ: paramString, choices: []string{"log", "modified_huber"}},
+		"penalty": {typ: paramString, choices: []string{"l1", "l2", "elasticnet"}},
+		"alpha":   {typ: paramFloat},
+		"n_iter":  {typ: paramInt},
+	}, defaults: map[string]json.RawMessage{"loss": json.RawMessage(`["log"]`)}},
+	"BernoulliNB": {sparse: true, params: map[string]paramSpec{
+		"alpha":    {typ: paramFloat},
+		"binarize": {typ: paramFloat},
+	}},
+	"RandomForestClassifier": {params: map[string]paramSpec{
+		"n_estimators":      {typ: paramInt},
+		"criterion":         {typ: paramString, choices: []string{"gini", "entropy"}},
+		"max_depth":         {typ: paramInt},
+		"min_samples_split": {typ: paramInt},
+		"min_samples_leaf":  {typ: paramInt},
+		"max_features":      {typ: paramNumber, choices: []string{"auto", "sqrt", "log2"}},
+	}},
+	"GradientBoostingClassifier": {params: map[string]paramSpec{
+		"n_estimators":     {typ: paramInt},
+		"learning_rate":    {typ: paramFloat},
+		"max_depth":        {typ: paramInt},
+		"min_samples_leaf": {typ: paramInt},
+		"subsample":        {typ: paramFloat},
+		"max_features":     {typ: paramNumber, choices: []string{"auto", "sqrt", "log2"}},
+	}},
+}
+
+// defaultSearch returns the candidates tried when a fit request does not name
+// any algorithms
+func defaultSearch(sparse bool) []Algorithm {
+	if sparse {
+		return []Algorithm{
+			{Name: "LogisticRegression"},
+			{Name: "SGDClassifier"},
+			{Name: "BernoulliNB"},
+		}
+	}
+	return []Algorithm{
+		{Name: "LogisticRegression"},
+		{Name: "GradientBoostingClassifier", Params: map[string]json.RawMessage{"n_estimators": json.RawMessage(`[150]`)}},
+		{Name: "RandomForestClassifier", Params: map[string]json.RawMessage{"n_estimators": json.RawMessage(`[150]`)}},
+	}
+}
+
+// allowedAlgorithms returns the names of the algorithms that may be used,
+// sorted
+func allowedAlgorithms() []string {
+	var names []string
+	for name := range algorithms {
+		if *algorithmsFlag == "" || contains(splitFormList([]string{*algorithmsFlag}), name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve fills in the defaults and checks the search against the allowed
+// algorithms and the profiled training data, a SearchError is returned listing
+// all problems found. Only algorithms accepting sparse input can be used with
+// sparse data, see Schema.isSparse, and the scoring metric must suit the labels.
+// Parameters that aren't listed are searched over the algorithm's defaults, see
+// algorithmSpec.
+func (s *Search) Resolve(ds *Dataset) error {
+	sparse := ds.Schema.isSparse()
+
+	if len(s.Algorithms) == 0 {
+		for _, alg := range defaultSearch(sparse) {
+			if contains(allowedAlgorithms(), alg.Name) {
+				s.Algorithms = append(s.Algorithms, alg)
+			}
+		}
+	}
+	if s.Strategy == "" {
+		s.Strategy = searchGrid
+	}
+	if s.Folds == 0 {
+		s.Folds = defaultFolds
+	}
+	if s.Scoring == "" {
+		s.Scoring = defaultScoring
+	}
+	if s.Iterations == 0 && s.Strategy == searchRandom {
+		s.Iterations = defaultIterations
+	}
+
+	var errs SearchError
+	if len(s.Algorithms) == 0 {
+		errs = append(errs, "no allowed algorithms")
+	}
+	if s.Strategy != searchGrid && s.Strategy != searchRandom {
+		errs = append(errs, fmt.Sprintf("unknown strategy %q, should be grid or random", s.Strategy))
+	}
+	if s.Folds < 2 || s.Folds > maxFolds {
+		errs = append(errs, fmt.Sprintf("folds should be between 2 and %d", maxFolds))
+	}
+	if s.Strategy == searchRandom && (s.Iterations < 1 || s.Iterations > maxIterations) {
+		errs = append(errs, fmt.Sprintf("iterations should be between 1 and %d", maxIterations))
+	}
+	if msg := checkScoring(s.Scoring, ds.labelStats().distinct()); msg != "" {
+		errs = append(errs, msg)
+	}
+
+	for i, alg := range s.Algorithms {
+		spec, ok := algorithms[alg.Name]
+		if !ok || !contains(allowedAlgorithms(), alg.Name) {
+			errs = append(errs, fmt.Sprintf("algorithm %q is not allowed, use one of %s", alg.Name, strings.Join(allowedAlgorithms(), ", ")))
+			continue
+		}
+		for name, val := range spec.defaults {
+			if _, ok := alg.Params[name]; ok {
+				continue
+			}
+			if alg.Params == nil {
+				alg.Params = make(map[string]json.RawMessage)
+			}
+			alg.Params[name] = val
+		}
+		s.Algorithms[i] = alg
+		if sparse && !spec.sparse {
+			errs = append(errs, fmt.Sprintf("algorithm %s can't be used with sparse data", alg.Name))
+		}
+
+		candidates := 1
+		for name, raw := range alg.Params {
+			p, ok := spec.params[name]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s parameter %q is not allowed", alg.Name, name))
+				continue
+			}
+			_, overridden := spec.defaults[name]
+			n, err := p.check(raw, s.Strategy == searchRandom, !overridden)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s parameter %s: %v", alg.Name, name, err))
+			}
+			candidates *= n
+		}
+		if s.Strategy == searchGrid && candidates > maxCandidates {
+			errs = append(errs, fmt.Sprintf("%s grid has %d combinations, at most %d are allowed", alg.Name, candidates, maxCandidates))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs) // parameters are checked in map order
+		return errs
+	}
+	return nil
+}
+
+// check validates the values to search for a parameter, returning the number
+// of values in the list. Distributions are only allowed for random searches,
+// null only when nullable is set, see accepts.
+func (p paramSpec) check(raw json.RawMessage, random, nullable bool) (int, error) {
+	var dist Distribution
+	if json.Unmarshal(raw, &dist) == nil && dist.Distribution != "" {
+		if !random {
+			return 1, fmt.Errorf("distributions can only be used with a random search")
+		}
+		return 1, p.checkDistribution(dist)
+	}
+
+	var vals []interface{}
+	err := json.Unmarshal(raw, &vals)
+	if err != nil || len(vals) == 0 {
+		return 1, fmt.Errorf("should be a non-empty list of values or a distribution")
+	}
+	for _, val := range vals {
+		if val == nil && !nullable {
+			return len(vals), fmt.Errorf("null is not allowed, the sklearn default has no predict_proba")
+		}
+		if !p.accepts(val) {
+			return len(vals), fmt.Errorf("%v is not a valid %s value", val, p.typ)
+		}
+	}
+	return len(vals), nil
+}
+
+func (p paramSpec) checkDistribution(d Distribution) error {
+	switch d.Distribution {
+	case "uniform", "loguniform", "randint":
+	default:
+		return fmt.Errorf("unknown distribution %q, should be uniform, loguniform, or randint", d.Distribution)
+	}
+	if p.typ != paramInt && p.typ != paramFloat && p.typ != paramNumber {
+		return fmt.Errorf("distributions can only be used for numeric parameters")
+	}
+	if p.typ == paramInt && d.Distribution != "randint" {
+		return fmt.Errorf("use randint for integer parameters")
+	}
+	if d.Low >= d.High {
+		return fmt.Errorf("low should be less than high")
+	}
+	if d.Distribution == "loguniform" && d.Low <= 0 {
+		return fmt.Errorf("loguniform low should be positive")
+	}
+	return nil
+}
+
+// accepts reports if a single JSON decoded value is valid for the parameter, null
+// means the sklearn default and is rejected by check for parameters whose
+// default the algorithm's spec replaces
+func (p paramSpec) accepts(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return true
+	case bool:
+		return p.typ == paramBool
+	case float64:
+		switch p.typ {
+		case paramInt:
+			return v == math.Trunc(v)
+		case paramFloat, paramNumber:
+			return true
+		}
+	case string:
+		return (p.typ == paramString || p.typ == paramNumber) && contains(p.choices, v)
+	}
+	return false
+}
+
+// searchFromForm reads the search form field, a JSON object described by
+// Search, and the scoring form field
+func searchFromForm(form map[string][]string) (Search, error) {
+	var s Search
+	if spec := formValue(form, "search"); spec != "" {
+		err := json.Unmarshal([]byte(spec), &s)
+		if err != nil {
+			return s, SearchError{fmt.Sprintf("search should be a JSON object: %v", err)}
+		}
+	}
+	if scoring := formValue(form, "scoring"); scoring != "" {
+		s.Scoring = scoring
+	}
+	return s, nil
+}
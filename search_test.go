@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// labeledDataset returns a dataset whose labels are the given values
+func labeledDataset(labels ...interface{}) *Dataset {
+	stats := newColumnStats()
+	for _, label := range labels {
+		stats.add(Schema{}, "", label)
+	}
+	return &Dataset{labels: stats, isRegression: stats.isNumeric()}
+}
+
+func TestResolveDefaultsSGDLoss(t *testing.T) {
+	s := Search{Algorithms: []Algorithm{{Name: "SGDClassifier"}}}
+	err := s.Resolve(labeledDataset("a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Algorithms[0].Params["loss"]); got != `["log"]` {
+		t.Errorf("loss = %s, want [\"log\"]", got)
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	tests := []struct {
+		alg    string
+		params string
+		err    string // empty when the search is valid
+	}{
+		{"SGDClassifier", `{"loss": ["modified_huber"]}`, ""},
+		{"SGDClassifier", `{"loss": [null]}`, "null is not allowed"},
+		{"SGDClassifier", `{"loss": ["hinge"]}`, "hinge is not a valid string value"},
+		{"RandomForestClassifier", `{"max_depth": [null, 5]}`, ""},
+		{"LogisticRegression", `{"C": [null]}`, ""},
+		{"LogisticRegression", `{"C": ["big"]}`, "big is not a valid float value"},
+		{"LogisticRegression", `{"tol": [0.1]}`, `parameter "tol" is not allowed`},
+	}
+
+	for _, tt := range tests {
+		var params map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+			t.Fatal(err)
+		}
+		s := Search{Algorithms: []Algorithm{{Name: tt.alg, Params: params}}}
+		err := s.Resolve(labeledDataset("a", "b"))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s %s: unexpected error %v", tt.alg, tt.params, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s %s: error %v, want %q", tt.alg, tt.params, err, tt.err)
+		}
+	}
+}
+
+func TestCheckScoring(t *testing.T) {
+	tests := []struct {
+		scoring string
+		classes int
+		err     string // empty when the metric can be used
+	}{
+		{"accuracy", 3, ""},
+		{"log_loss", 3, ""},
+		{"roc_auc", 2, ""},
+		{"roc_auc", 3, "requires 2 classes"},
+		{"r2", 2, "only classification models are supported"},
+		{"rmse", 40, "only classification models are supported"},
+		{"precision", 2, `unknown scoring "precision"`},
+	}
+
+	for _, tt := range tests {
+		msg := checkScoring(tt.scoring, tt.classes)
+		if (tt.err == "") != (msg == "") || !strings.Contains(msg, tt.err) {
+			t.Errorf("checkScoring(%q, %d) = %q, want %q", tt.scoring, tt.classes, msg, tt.err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNoSnapshot is returned when retraining a model fit without keeping a
+// snapshot of its training data
+var ErrNoSnapshot = errors.New("mlserver: model has no training data snapshot, fit it with snapshot=true to retrain it")
+
+// FitConfig is how a model was fit, saved in <model_id>.fit.json so the model
+// can be retrained the same way. Schema is the schema as requested, with the
+// target and csv dialect resolved against the data. When Snapshot is set the
+// rows as received are kept in <model_id>.data.jsonl, along with the labels in
+// <model_id>.labels.jsonl when they were supplied separately, or as svmlight
+// in <model_id>.data.svm.
+type FitConfig struct {
+	Name     string   `json:"name"`
+	Schema   Schema   `json:"schema"`
+	Search   Search   `json:"search"`
+	Rows     int      `json:"rows"`
+	Snapshot string   `json:"snapshot,omitempty"` // format of the snapshot, ndjson or svmlight
+	Labels   bool     `json:"labels,omitempty"`   // the snapshot has a separate labels file
+	Lineage  *Lineage `json:"lineage,omitempty"`
+}
+
+// Lineage records the model a retrained model was fit from and where its
+// training rows came from
+type Lineage struct {
+	ParentID     string `json:"parent_id"`
+	SnapshotRows int    `json:"snapshot_rows"` // rows of the parent's training data
+	FeedbackRows int    `json:"feedback_rows"` // predictions of the parent with feedback
+	AppendedRows int    `json:"appended_rows"` // rows sent with the retrain request
+}
+
+// snapshotFromForm reads the snapshot form field
+func snapshotFromForm(form map[string][]string) (bool, error) {
+	val := formValue(form, "snapshot")
+	if val == "" {
+		return false, nil
+	}
+	snapshot, err := strconv.ParseBool(strings.TrimSpace(val))
+	if err != nil {
+		return false, errors.New("mlserver: snapshot should be true or false")
+	}
+	return snapshot, nil
+}
+
+// fitConfig returns the configuration of the dataset, it should be called
+// after Profile
+func (ds *Dataset) fitConfig() FitConfig {
+	s := ds.requested
+	s.Target, s.Dialect = ds.Schema.Target, ds.Schema.Dialect
+	return FitConfig{
+		Name:    ds.Name,
+		Schema:  s,
+		Search:  ds.Search,
+		Rows:    ds.Rows,
+		Lineage: ds.lineage,
+	}
+}
+
+// writeSnapshot copies the rows of the dataset as received to the model
+// directory, delimited text is kept as JSON rows, and records the snapshot
+// files in cfg
+func (ds *Dataset) writeSnapshot(dir, id string, cfg *FitConfig) error {
+	cfg.Snapshot = formatNDJSON
+	if ds.format == formatSVMLight {
+		cfg.Snapshot = formatSVMLight
+	}
+	cfg.Labels = ds.labelPath != ""
+
+	data, labels := snapshotPaths(dir, id, *cfg)
+	w, err := newSnapshotWriter(data, labels, cfg.Snapshot, ds.Schema.Target, os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	err = ds.eachRaw(w.add)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// snapshotPaths returns the paths of the snapshot data and labels, the labels
+// path is empty when they are not kept separately
+func snapshotPaths(dir, id string, cfg FitConfig) (string, string) {
+	if cfg.Snapshot == formatSVMLight {
+		return filepath.Join(dir, id+".data.svm"), ""
+	}
+	var labels string
+	if cfg.Labels {
+		labels = filepath.Join(dir, id+".labels.jsonl")
+	}
+	return filepath.Join(dir, id+".data.jsonl"), labels
+}
+
+// FitConfig returns how the model was fit, an error satisfying os.IsNotExist
+// is returned for models fit before the configuration was saved
+func (m *Model) FitConfig() (FitConfig, error) {
+	var cfg FitConfig
+	err := readJSONFile(filepath.Join(m.dir, m.ID+".fit.json"), &cfg)
+	return cfg, err
+}
+
+// RetrainDataset returns a dataset for fitting a new model from the training
+// data snapshot of the model, the rows of its predictions that received
+// feedback, labeled with the feedback, and the rows of extra, which may be nil.
+// The dataset is profiled and its search resolved with the configuration of
+// the model, and a snapshot is kept of the new model's data as well. The
+// caller is responsible for removing the returned Dataset. The snapshot is
+// copied from storage if it's not in the model directory.
+func (m *Model) RetrainDataset(extra *Dataset) (*Dataset, error) {
+	cfg, err := m.FitConfig()
+	if os.IsNotExist(err) || (err == nil && cfg.Snapshot == "") {
+		return nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &Dataset{
+		Name:      cfg.Name,
+		Schema:    cfg.Schema,
+		Search:    cfg.Search,
+		Snapshot:  true,
+		format:    cfg.Snapshot,
+		requested: cfg.Schema,
+		lineage:   &Lineage{ParentID: m.ID, SnapshotRows: cfg.Rows},
+	}
+
+	data, labels := snapshotPaths(m.dir, m.ID, cfg)
+	err = m.fetch(filepath.Base(data))
+	if err == nil && labels != "" {
+		err = m.fetch(filepath.Base(labels))
+	}
+	if err == nil {
+		ds.path, err = spoolFile(data)
+	}
+	if err == nil && labels != "" {
+		ds.labelPath, err = spoolFile(labels)
+	}
+	if err != nil {
+		ds.Remove()
+		return nil, err
+	}
+
+	err = ds.appendRows(m, extra)
+	if err == nil {
+		err = ds.Profile()
+	}
+	if err == nil {
+		err = ds.Search.Resolve(ds)
+	}
+	if err != nil {
+		ds.Remove()
+		return nil, err
+	}
+	return ds, nil
+}
+
+// appendRows adds the predictions of the parent model with feedback and the
+// rows of extra to the spooled snapshot, counting them in the lineage
+func (ds *Dataset) appendRows(parent *Model, extra *Dataset) error {
+	records, err := parent.Feedback()
+	if err != nil {
+		return err
+	}
+
+	w, err := newSnapshotWriter(ds.path, ds.labelPath, ds.format, ds.Schema.Target, os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if rec.Data == nil {
+			continue
+		}
+		err = w.add(rec.Data, rec.Label)
+		if err != nil {
+			break
+		}
+		ds.lineage.FeedbackRows++
+	}
+	if err == nil && extra != nil {
+		err = extra.eachRaw(func(row map[string]interface{}, label interface{}) error {
+			ds.lineage.AppendedRows++
+			return w.add(row, label)
+		})
+	}
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// spoolFile copies the file at path to a temporary file, see spool
+func spoolFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return spool(f)
+}
+
+// snapshotWriter writes labeled rows as JSON rows, with the label in the target
+// column or a separate labels file, or as svmlight
+type snapshotWriter struct {
+	format string
+	target string
+	files  []*os.File
+	data   *bufio.Writer
+	labels *bufio.Writer // nil unless labels are kept separately
+}
+
+// newSnapshotWriter opens the data and labels files for writing, labels is
+// empty unless labels are kept separately. flag is os.O_TRUNC or os.O_APPEND.
+func newSnapshotWriter(data, labels, format, target string, flag int) (*snapshotWriter, error) {
+	w := &snapshotWriter{format: format, target: target}
+	for _, path := range []string{data, labels} {
+		if path == "" {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.files = append(w.files, f)
+	}
+	w.data = bufio.NewWriter(w.files[0])
+	if labels != "" {
+		w.labels = bufio.NewWriter(w.files[1])
+	}
+	return w, nil
+}
+
+// add writes a row, label is nil when the label is in the target column
+func (w *snapshotWriter) add(row map[string]interface{}, label interface{}) error {
+	if label == nil && w.target != "" {
+		label = row[w.target]
+	}
+	if label == nil {
+		return errors.New("mlserver: rows added to the training data should have a label")
+	}
+
+	if w.format == formatSVMLight {
+		names := make([]string, 0, len(row))
+		for name := range row {
+			names = append(names, name)
+		}
+		return writeSVMLightRow(w.data, label, names, row)
+	}
+
+	if w.labels != nil {
+		err := writeJSONLine(w.labels, label)
+		if err != nil {
+			return err
+		}
+	} else {
+		row[w.target] = label
+	}
+	return writeJSONLine(w.data, row)
+}
+
+// Close flushes the buffered rows and closes the files
+func (w *snapshotWriter) Close() error {
+	var err error
+	for _, b := range []*bufio.Writer{w.data, w.labels} {
+		if b != nil && err == nil {
+			err = b.Flush()
+		}
+	}
+	for _, f := range w.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// writeSVMLightRow writes a line of svmlight data holding the named features of
+// the row, sorted by name
+func writeSVMLightRow(w io.Writer, label interface{}, names []string, row map[string]interface{}) error {
+	sort.Strings(names)
+
+	_, err := io.WriteString(w, categoricalValue(label))
+	for _, name := range names {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, " %s:%s", name, categoricalValue(row[name]))
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\n")
+	}
+	return err
+}
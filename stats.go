@@ -0,0 +1,274 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// columnStats accumulates statistics for the values of a single column while
+// a dataset is profiled. Memory use does not depend on the number of rows.
+type columnStats struct {
+	count     int     // non-missing values
+	numeric   int     // values that parse as numbers
+	sum       float64 // sum of the numeric values
+	sumSq     float64 // sum of the squared numeric values
+	example   string  // first non-numeric value, used in error messages
+	times     int     // values that parse as dates or timestamps
+	notTime   string  // first value that isn't a timestamp, used in error messages
+	quantiles *quantileSketch
+	epochs    *quantileSketch // seconds since 1970-01-01 UTC of the timestamps
+	frequent  *frequentValues
+}
+
+func newColumnStats() *columnStats {
+	return &columnStats{
+		quantiles: &quantileSketch{},
+		epochs:    &quantileSketch{},
+		frequent:  newFrequentValues(frequentCapacity),
+	}
+}
+
+// add records a raw csv or JSON value of column col, missing values are
+// skipped
+func (c *columnStats) add(s Schema, col string, raw interface{}) {
+	val, ok := s.parseColumn(col, raw)
+	if !ok {
+		return
+	}
+
+	c.count++
+	c.frequent.add(categoricalValue(raw))
+
+	if t, isTime := parseTime(raw); isTime {
+		c.times++
+		c.epochs.add(float64(t.UnixNano()) / 1e9)
+	} else if c.notTime == "" {
+		c.notTime = categoricalValue(raw)
+	}
+
+	num, isNum := val.(float64)
+	if !isNum {
+		if c.example == "" {
+			c.example = categoricalValue(raw)
+		}
+		return
+	}
+	c.numeric++
+	c.sum += num
+	c.sumSq += num * num
+	c.quantiles.add(num)
+}
+
+// isNumeric reports if every non-missing value is a number
+func (c *columnStats) isNumeric() bool {
+	return c.count == c.numeric
+}
+
+// distinct returns the number of distinct values, the count is exact for up to
+// frequentCapacity values, see exactDistinct
+func (c *columnStats) distinct() int {
+	if c.frequent.overflow {
+		return c.frequent.capacity
+	}
+	return len(c.frequent.counts)
+}
+
+// exactDistinct reports if distinct is the exact number of distinct values,
+// otherwise there are more than frequentCapacity
+func (c *columnStats) exactDistinct() bool {
+	return !c.frequent.overflow
+}
+
+// isDatetime reports if every non-missing value is a date or timestamp
+func (c *columnStats) isDatetime() bool {
+	return c.count > 0 && c.count == c.times
+}
+
+//-----------------------------------------------------------------------------
+// Quantile Sketch
+//-----------------------------------------------------------------------------
+
+const (
+	sketchCentroids = 200  // each centroid holds at most 1/sketchCentroids of the values
+	sketchBuffer    = 2000 // values buffered before merging into the centroids
+)
+
+type centroid struct {
+	mean  float64
+	count int
+}
+
+// quantileSketch approximates the distribution of a stream of values. Incoming
+// values are buffered, then merged with the existing centroids, adjacent
+// centroids are combined as long as the result holds at most 1/sketchCentroids
+// of the values. Quantiles are exact for fewer than sketchCentroids values and
+// otherwise accurate to about 1/sketchCentroids in rank.
+type quantileSketch struct {
+	centroids []centroid
+	buf       []float64
+	count     int
+	min, max  float64
+}
+
+func (q *quantileSketch) add(val float64) {
+	if q.count == 0 || val < q.min {
+		q.min = val
+	}
+	if q.count == 0 || val > q.max {
+		q.max = val
+	}
+	q.count++
+
+	q.buf = append(q.buf, val)
+	if len(q.buf) >= sketchBuffer {
+		q.flush()
+	}
+}
+
+// flush merges the buffered values into the centroids
+func (q *quantileSketch) flush() {
+	if len(q.buf) == 0 {
+		return
+	}
+	sort.Float64s(q.buf)
+
+	merged := make([]centroid, 0, len(q.centroids)+len(q.buf))
+	i, j := 0, 0
+	for i < len(q.centroids) || j < len(q.buf) {
+		if j == len(q.buf) || (i < len(q.centroids) && q.centroids[i].mean <= q.buf[j]) {
+			merged = append(merged, q.centroids[i])
+			i++
+		} else {
+			merged = append(merged, centroid{q.buf[j], 1})
+			j++
+		}
+	}
+	q.buf = q.buf[:0]
+
+	limit := q.count / sketchCentroids
+	if limit < 1 {
+		limit = 1
+	}
+
+	q.centroids = merged[:0]
+	for _, c := range merged {
+		n := len(q.centroids)
+		if n > 0 && q.centroids[n-1].count+c.count <= limit {
+			last := &q.centroids[n-1]
+			total := last.count + c.count
+			last.mean += (c.mean - last.mean) * float64(c.count) / float64(total)
+			last.count = total
+			continue
+		}
+		q.centroids = append(q.centroids, c)
+	}
+}
+
+// quantile returns the approximate value at quantile p (0 <= p <= 1), NaN is
+// returned when no values have been added. Each centroid is placed at the
+// middle of the ranks it covers and values are interpolated between them.
+func (q *quantileSketch) quantile(p float64) float64 {
+	q.flush()
+	if q.count == 0 {
+		return math.NaN()
+	}
+
+	target := p * float64(q.count)
+	prevRank, prevVal := 0.0, q.min
+	var cum float64
+	for _, c := range q.centroids {
+		mid := cum + float64(c.count)/2
+		if target < mid {
+			return prevVal + (target-prevRank)/(mid-prevRank)*(c.mean-prevVal)
+		}
+		prevRank, prevVal = mid, c.mean
+		cum += float64(c.count)
+	}
+
+	if cum == prevRank {
+		return q.max
+	}
+	return prevVal + (target-prevRank)/(cum-prevRank)*(q.max-prevVal)
+}
+
+//-----------------------------------------------------------------------------
+// Frequent Values
+//-----------------------------------------------------------------------------
+
+const frequentCapacity = 256 // distinct values tracked per column
+
+// frequentValues finds the most common values of a stream using the
+// Misra-Gries algorithm. Counts are exact while there are fewer than capacity
+// distinct values, otherwise they are lower bounds and any value occurring in
+// more than 1/capacity of the stream is guaranteed to be tracked.
+type frequentValues struct {
+	counts   map[string]int
+	capacity int
+	overflow bool // more than capacity distinct values were seen
+}
+
+type valueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+func newFrequentValues(capacity int) *frequentValues {
+	return &frequentValues{
+		counts:   make(map[string]int),
+		capacity: capacity,
+	}
+}
+
+func (f *frequentValues) add(val string) {
+	if _, ok := f.counts[val]; ok || len(f.counts) < f.capacity {
+		f.counts[val]++
+		return
+	}
+
+	// table is full, decrement every counter and drop those reaching zero
+	f.overflow = true
+	for v := range f.counts {
+		f.counts[v]--
+		if f.counts[v] == 0 {
+			delete(f.counts, v)
+		}
+	}
+}
+
+// mode returns the tracked value with the highest count, false is returned
+// when no value is tracked: the stream is empty, or no value was frequent
+// enough to keep its counter once the table filled
+func (f *frequentValues) mode() (string, bool) {
+	top := f.top(1)
+	if len(top) == 0 {
+		return "", false
+	}
+	return top[0].Value, true
+}
+
+// top returns up to n values ordered by decreasing count, ties are ordered by
+// value so the result doesn't depend on row order
+func (f *frequentValues) top(n int) []valueCount {
+	vals := make([]valueCount, 0, len(f.counts))
+	for v, count := range f.counts {
+		vals = append(vals, valueCount{v, count})
+	}
+	sort.Sort(byCount(vals))
+
+	if len(vals) > n {
+		vals = vals[:n]
+	}
+	return vals
+}
+
+// byCount sorts valueCounts by decreasing count, then by value
+type byCount []valueCount
+
+func (v byCount) Len() int      { return len(v) }
+func (v byCount) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byCount) Less(i, j int) bool {
+	if v[i].Count != v[j].Count {
+		return v[i].Count > v[j].Count
+	}
+	return v[i].Value < v[j].Value
+}
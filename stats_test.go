@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFrequentValuesMode(t *testing.T) {
+	f := newFrequentValues(4)
+	if _, ok := f.mode(); ok {
+		t.Error("empty stream has a mode")
+	}
+
+	for _, v := range []string{"a", "b", "a", "c", "a", "b"} {
+		f.add(v)
+	}
+	if mode, ok := f.mode(); !ok || mode != "a" {
+		t.Errorf("mode = %q, %v, want a", mode, ok)
+	}
+
+	// a heavy hitter survives the decrements of a full table
+	f = newFrequentValues(4)
+	for i := 0; i < 100; i++ {
+		f.add("x")
+		f.add(fmt.Sprint(i))
+	}
+	if mode, ok := f.mode(); !ok || mode != "x" {
+		t.Errorf("mode = %q, %v, want x", mode, ok)
+	}
+
+	// distinct values empty the table
+	f = newFrequentValues(4)
+	for i := 0; i < 5; i++ {
+		f.add(fmt.Sprint(i))
+	}
+	if mode, ok := f.mode(); ok {
+		t.Errorf("mode of distinct values = %q, want none", mode)
+	}
+}
+
+func TestQuantileSketch(t *testing.T) {
+	q := &quantileSketch{}
+	for i := 1000; i > 0; i-- {
+		q.add(float64(i))
+	}
+	for _, p := range []float64{0.01, 0.5, 0.99} {
+		if got, want := q.quantile(p), p*1000; math.Abs(got-want) > 20 {
+			t.Errorf("quantile(%v) = %v, want about %v", p, got, want)
+		}
+	}
+	if q.min != 1 || q.max != 1000 {
+		t.Errorf("min, max = %v, %v, want 1, 1000", q.min, q.max)
+	}
+}
+
+func TestMostFrequentWithoutMode(t *testing.T) {
+	var data strings.Builder
+	data.WriteString("label,id,x\n")
+	// the table empties once every value was seen once
+	for i := 0; i <= frequentCapacity; i++ {
+		fmt.Fprintf(&data, "a,id%d,%d\n", i, i%2)
+	}
+	data.WriteString("b,,\n")
+
+	ds := profileCSV(t, data.String(), Schema{Target: "label", Impute: "most_frequent"})
+	defer ds.Remove()
+
+	if val, ok := ds.Schema.Fill["id"]; ok {
+		t.Errorf("id filled with %v, want no fill", val)
+	}
+	if val := ds.Schema.Fill["x"]; val != 0.0 {
+		t.Errorf("x filled with %v, want 0", val)
+	}
+	for _, c := range ds.DataProfile().Columns {
+		if c.NotImputed != (c.Name == "id") {
+			t.Errorf("column %s not_imputed = %v", c.Name, c.NotImputed)
+		}
+	}
+}
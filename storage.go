@@ -0,0 +1,347 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// Storage keeps the artifacts of fitted models, the files of each model's
+// directory. Models are served from a local copy of their artifacts, see
+// ModelRepo, artifacts are named as in the model directory, <model_id>.pkl,
+// <model_id>.json, ...
+type Storage interface {
+	// List returns the ids of the stored models
+	List() ([]string, error)
+	// Metadata opens <model_id>.json, ErrModelNotFound is returned for
+	// unknown models
+	Metadata(id string) (io.ReadCloser, error)
+	// Artifacts returns the names of the stored artifacts of a model
+	Artifacts(id string) ([]string, error)
+	// Fetch copies an artifact of a model to the local file at path, an error
+	// satisfying os.IsNotExist is returned for missing artifacts
+	Fetch(id, name, path string) error
+	// Put stores the local file at path as an artifact of a model, replacing
+	// the artifact if it exists
+	Put(id, name, path string) error
+	// Remove removes an artifact of a model, removing a missing artifact is
+	// not an error
+	Remove(id, name string) error
+}
+
+// localStorage keeps models in directories <path>/<model_id>, when path is the
+// directory models are served from, fetching and putting artifacts does nothing
+type localStorage struct {
+	path string
+}
+
+func (s localStorage) List() ([]string, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, fi := range files {
+		if fi.IsDir() {
+			ids = append(ids, fi.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (s localStorage) Metadata(id string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.path, id, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrModelNotFound
+	}
+	return f, err
+}
+
+func (s localStorage) Artifacts(id string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.path, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range files {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s localStorage) Fetch(id, name, path string) error {
+	return copyFile(filepath.Join(s.path, id, name), path)
+}
+
+func (s localStorage) Put(id, name, path string) error {
+	dir := filepath.Join(s.path, id)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return copyFile(path, filepath.Join(dir, name))
+}
+
+func (s localStorage) Remove(id, name string) error {
+	err := os.Remove(filepath.Join(s.path, id, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// copyFile replaces the file at dst with a copy of src, nothing is copied when
+// they are the same file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	srcInfo, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+
+	return writeFileFrom(dst, in)
+}
+
+// writeFileFrom replaces the file at path with the contents of r, the contents
+// are written to a temporary file that is renamed once complete
+func writeFileFrom(path string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// lazyArtifact reports whether an artifact of a model is left in storage until
+// it's needed, the pickled model until a worker starts, the training data
+// snapshot until the model is retrained, and the saved predictions until
+// feedback is received for them
+func lazyArtifact(id, name string) bool {
+	switch name {
+	case id + ".pkl", id + ".data.jsonl", id + ".labels.jsonl", id + ".data.svm":
+		return true
+	}
+	_, ok := segmentNumber(id, name)
+	return ok
+}
+
+// cacheModel copies the artifacts of a model that are not lazy, see
+// lazyArtifact, to the local model directory dir, artifacts already in dir are
+// kept
+func cacheModel(store Storage, id, dir string) error {
+	names, err := store.Artifacts(id)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if lazyArtifact(id, name) {
+			continue
+		}
+		err = fetchMissing(store, id, name, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchMissing fetches an artifact unless it's already at path
+func fetchMissing(store Storage, id, name, path string) error {
+	_, err := os.Stat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return store.Fetch(id, name, path)
+}
+
+// fetch copies the named artifacts of the model from storage to the model
+// directory, artifacts already in the directory are kept
+func (m *Model) fetch(names ...string) error {
+	if m.store == nil {
+		return nil
+	}
+	err := os.MkdirAll(m.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = fetchMissing(m.store, m.ID, name, filepath.Join(m.dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persist copies the named artifacts of the model from the model directory to
+// storage
+func (m *Model) persist(names ...string) error {
+	if m.store == nil {
+		return nil
+	}
+	for _, name := range names {
+		err := m.store.Put(m.ID, name, filepath.Join(m.dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persistAll copies every file of the model directory to storage, the
+// metadata, <model_id>.json, is copied last so the model isn't loaded from
+// storage before its other artifacts are stored
+func (m *Model) persistAll() error {
+	files, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var metadata bool
+	for _, fi := range files {
+		switch {
+		case !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), "."):
+		case fi.Name() == m.ID+".json":
+			metadata = true
+		default:
+			names = append(names, fi.Name())
+		}
+	}
+	if metadata {
+		names = append(names, m.ID+".json")
+	}
+	return m.persist(names...)
+}
+
+// persistPredictions copies the segments of the saved predictions started
+// since the last copy to storage, and the current segment if rows were
+// predicted since it was last copied. Segments are stored once more after they
+// are rotated, and removed from storage along with the local copies, so only
+// the current segment, at most -saved-predictions-max-size bytes, is copied
+// repeatedly. The predictions are appended to on every predict request, so
+// they are copied periodically rather than as they change, see
+// ModelRepo.SyncPredictions.
+func (m *Model) persistPredictions() error {
+	if m.store == nil {
+		return nil
+	}
+	m.predictionsLock.Lock()
+	current, synced, unsynced := m.segment, m.synced, m.unsynced
+	// copy the current segment so predict requests aren't blocked while it's
+	// stored, rotated segments are no longer appended to
+	var path string
+	var err error
+	if unsynced {
+		path, err = spoolFile(m.segmentPath(current))
+		if err == nil {
+			m.unsynced = false
+		}
+	}
+	m.predictionsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		defer os.Remove(path)
+	}
+
+	for segment := synced + 1; segment < current; segment++ {
+		name := filepath.Base(m.segmentPath(segment))
+		err = m.store.Put(m.ID, name, filepath.Join(m.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			break
+		}
+		err = nil
+	}
+	if err == nil && path != "" {
+		err = m.store.Put(m.ID, filepath.Base(m.segmentPath(current)), path)
+	}
+	if err == nil && synced < current-1 {
+		err = m.pruneStoredSegments(current)
+	}
+
+	m.predictionsLock.Lock()
+	if err != nil {
+		m.unsynced = m.unsynced || unsynced
+	} else if m.synced < current-1 {
+		m.synced = current - 1
+	}
+	m.predictionsLock.Unlock()
+	return err
+}
+
+// pruneStoredSegments removes the stored segments of the saved predictions
+// beyond -saved-predictions-max-files when current is the newest segment
+func (m *Model) pruneStoredSegments(current int) error {
+	segments, err := m.storedSegments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment > current-*savedPredictionsFiles {
+			break
+		}
+		err = m.store.Remove(m.ID, filepath.Base(m.segmentPath(segment)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncPredictions copies the predictions of the loaded models to storage every
+// interval, see Model.persistPredictions. It does not return, and should only
+// be run when models aren't stored in the directory they're served from.
+func (r *ModelRepo) SyncPredictions(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		for _, m := range r.All() {
+			err := m.persistPredictions()
+			if err != nil {
+				log.Errorf("unable to store predictions of model %v: %v", m.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// svmlight (libsvm) data holds one row per line, a label followed by the
+// non-zero features as index:value pairs:
+//
+//		<label> <index>:<value> <index>:<value> ...
+//		1 3:0.5 17:1 20418:0.25 # comment
+//
+// The rows are kept as maps holding only the non-zero features, so memory use
+// depends on the number of non-zero values rather than the number of features.
+// Feature names are the indexes as written, qid:<n> pairs are ignored.
+
+// parseSVMLightLine parses a single line of svmlight data. The label is empty
+// when the first field is an index:value pair, as in predict requests. A nil
+// row is returned for blank and comment lines.
+func parseSVMLightLine(line string) (string, map[string]interface{}, error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+
+	var label string
+	if !strings.Contains(fields[0], ":") {
+		label, fields = fields[0], fields[1:]
+	}
+
+	row := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		i := strings.LastIndex(field, ":")
+		if i <= 0 {
+			return "", nil, fmt.Errorf("expected index:value, found %q", field)
+		}
+		name := field[:i]
+		if name == "qid" {
+			continue
+		}
+		val, err := strconv.ParseFloat(field[i+1:], 64)
+		if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+			return "", nil, fmt.Errorf("feature %s has value %q", name, field[i+1:])
+		}
+		row[name] = val
+	}
+	return label, row, nil
+}
+
+// readSVMLight calls fn for each row of svmlight data read from r, lines are
+// numbered from 1
+func readSVMLight(r io.Reader, fn func(n int, label string, row map[string]interface{}) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			return nil
+		}
+
+		label, row, perr := parseSVMLightLine(line)
+		if perr != nil {
+			return fmt.Errorf("mlserver: svmlight line %d: %v", n, perr)
+		}
+		if row != nil {
+			if ferr := fn(n, label, row); ferr != nil {
+				return ferr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// ParseSVMLight parses svmlight data for a predict request, the label at the
+// start of each line is optional and ignored. The rows are transformed
+// according to the schema saved with the model, see Schema.Apply.
+func ParseSVMLight(r io.Reader, s Schema) (ModelReq, error) {
+	var d ModelReq
+	err := readSVMLight(r, func(n int, label string, row map[string]interface{}) error {
+		d.Data = append(d.Data, row)
+		return nil
+	})
+	if err != nil {
+		return ModelReq{}, err
+	}
+
+	s.Apply(&d)
+
+	return d, nil
+}
+
+func (ds *Dataset) eachSVMLight(r io.Reader, fn func(row map[string]interface{}, label interface{}) error) error {
+	return readSVMLight(r, func(n int, label string, row map[string]interface{}) error {
+		if label == "" {
+			return fmt.Errorf("mlserver: svmlight line %d is missing a label", n)
+		}
+		return fn(row, label)
+	})
+}
+
+// WriteSVMLight writes the training data of a sparse dataset in svmlight format,
+// features are written sorted by name and zero values are left out
+func (ds *Dataset) WriteSVMLight(w io.Writer) error {
+	s := ds.Schema
+	var names []string
+
+	return ds.each(func(row map[string]interface{}, label interface{}) error {
+		if ds.isRegression {
+			label, _ = s.parseCell(label)
+		}
+		s.applyRow(row)
+
+		names = names[:0]
+		for name, val := range row {
+			if num, ok := val.(float64); ok && num != 0 {
+				names = append(names, name)
+			}
+		}
+		return writeSVMLightRow(w, label, names, row)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSVMLightLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		label string
+		row   map[string]interface{}
+		err   string // empty when the line is valid
+	}{
+		{"1 3:0.5 17:1 # comment\n", "1", map[string]interface{}{"3": 0.5, "17": 1.0}, ""},
+		{"-1 qid:4 2:-2.5e-1", "-1", map[string]interface{}{"2": -0.25}, ""},
+		{"3:1 4:0", "", map[string]interface{}{"3": 1.0, "4": 0.0}, ""},
+		{"yes", "yes", map[string]interface{}{}, ""},
+		{"   \n", "", nil, ""},
+		{"# only a comment", "", nil, ""},
+		{"1 3", "", nil, `expected index:value, found "3"`},
+		{"1 :5", "", nil, `expected index:value, found ":5"`},
+		{"1 3:x", "", nil, `feature 3 has value "x"`},
+		{"1 3:NaN", "", nil, `feature 3 has value "NaN"`},
+		{"1 3:Inf", "", nil, `feature 3 has value "Inf"`},
+	}
+
+	for _, tt := range tests {
+		label, row, err := parseSVMLightLine(tt.line)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: error %v, want %q", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.line, err)
+			continue
+		}
+		if label != tt.label || !reflect.DeepEqual(row, tt.row) {
+			t.Errorf("%q: label %q row %v, want %q %v", tt.line, label, row, tt.label, tt.row)
+		}
+	}
+}
+
+func TestReadSVMLightLineNumbers(t *testing.T) {
+	var lines []int
+	err := readSVMLight(strings.NewReader("1 1:1\n\n# skipped\n0 2:1"), func(n int, label string, row map[string]interface{}) error {
+		lines = append(lines, n)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 4}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("rows on lines %v, want %v", lines, want)
+	}
+
+	err = readSVMLight(strings.NewReader("1 1:1\n1 1:x\n"), func(int, string, map[string]interface{}) error { return nil })
+	if err == nil || !strings.HasPrefix(err.Error(), "mlserver: svmlight line 2:") {
+		t.Errorf("error %v, want one for line 2", err)
+	}
+}
+
+// profileSVMLight spools svmlight data and profiles it with the schema, the
+// caller removes the returned dataset
+func profileSVMLight(data string, s Schema) (*Dataset, error) {
+	path, err := spool(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	ds := &Dataset{format: formatSVMLight, path: path, Schema: s}
+	return ds, ds.Profile()
+}
+
+// predictSVMLight parses svmlight data the way a predict request is parsed
+func predictSVMLight(t *testing.T, data string, s Schema) []map[string]interface{} {
+	d, err := ParseSVMLight(strings.NewReader(data), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Data
+}
+
+func TestProfileSVMLight(t *testing.T) {
+	ds, err := profileSVMLight("a 1:0.5 7:2\nb 3:1\na 7:0\n", Schema{})
+	defer ds.Remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ds.Schema.Sparse || ds.Rows != 3 || len(ds.stats) != 0 {
+		t.Errorf("sparse %v, %d rows, %d column stats, want sparse, 3 rows, no column stats", ds.Schema.Sparse, ds.Rows, len(ds.stats))
+	}
+
+	var buf bytes.Buffer
+	err = ds.WriteSVMLight(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a 1:0.5 7:2\nb 3:1\na\n"; buf.String() != want {
+		t.Errorf("written svmlight\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	rows := predictSVMLight(t, "7:1 2:3\n", ds.Schema)
+	if want := map[string]interface{}{"7": 1.0, "2": 3.0}; !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("predict row %v, want %v", rows[0], want)
+	}
+}
+
+func TestProfileSVMLightErrors(t *testing.T) {
+	tests := []struct {
+		data   string
+		schema Schema
+		err    string
+	}{
+		{"1:1 2:1\n", Schema{}, "svmlight line 1 is missing a label"},
+		{"a 1:1\n", Schema{Target: "label"}, "can't be used with svmlight data"},
+		{"a 1:1\n", Schema{Impute: "mean"}, "impute can't be used"},
+	}
+
+	for _, tt := range tests {
+		ds, err := profileSVMLight(tt.data, tt.schema)
+		ds.Remove()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q %+v: error %v, want %q", tt.data, tt.schema, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+import scipy.sparse
+
+from sklearn.base import BaseEstimator, TransformerMixin
+from sklearn.feature_extraction import DictVectorizer
+from sklearn.feature_extraction.text import TfidfVectorizer
+
+# shared by fit.py and predict.py, mlserver runs this source ahead of either
+# script so that fitted pipelines using these classes can be unpickled
+
+class ColumnVectorizer(BaseEstimator, TransformerMixin):
+	"""vectorize rows of feature:value dicts, text columns are tokenized and
+	weighted by TF-IDF, keeping at most max_features terms per column, the
+	remaining columns are passed to a DictVectorizer"""
+
+	def __init__(self, text_columns=(), max_features=None, sparse=True):
+		self.text_columns = text_columns
+		self.max_features = max_features
+		self.sparse = sparse
+
+	def _other(self, x):
+		return {k: v for k, v in x.items() if k not in self.text_columns}
+
+	def fit(self, X, y=None):
+		self.vec_ = DictVectorizer(sparse=True)
+		self.vec_.fit([self._other(x) for x in X])
+		self.text_ = {}
+		for col in self.text_columns:
+			tfidf = TfidfVectorizer(max_features=self.max_features)
+			tfidf.fit([x.get(col, '') for x in X])
+			self.text_[col] = tfidf
+		return self
+
+	def transform(self, X):
+		parts = [self.vec_.transform([self._other(x) for x in X])]
+		for col in self.text_columns:
+			parts.append(self.text_[col].transform([x.get(col, '') for x in X]))
+		out = scipy.sparse.hstack(parts).tocsr()
+		return out if self.sparse else out.toarray()
+
+	def get_feature_names(self):
+		"""names of the output columns, terms of a text column are named
+		<column>=<term> like the one-hot features of DictVectorizer"""
+		names = list(self.vec_.get_feature_names())
+		for col in self.text_columns:
+			names.extend(col + '=' + term for term in self.text_[col].get_feature_names())
+		return names
+
+	def vocabulary_sizes(self):
+		return {col: len(self.text_[col].vocabulary_) for col in self.text_columns}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -14,22 +14,84 @@ import (
 	zmq "github.com/pebbe/zmq4"
 )
 
-// fitModel writes the training data in json format to a temporary file. Next
-// it launches the fit.py in a child process, passing the filename of the trainig
-// data and the location where the model should be saved as arguments. Since we
-// do not know the path the app will be run, we instruct python to read the fit.py
-// source from stdin instead of executing a file. This would be equivalent to:
+// fitManifest describes the training data passed to fit.py
+type fitManifest struct {
+	Name        string            `json:"name"`
+	Data        string            `json:"data"`         // file written by Dataset.WriteCSV or WriteSVMLight
+	Format      string            `json:"format"`       // csv or svmlight
+	Types       map[string]string `json:"types"`        // type of each feature column
+	LabelType   string            `json:"label_type"`   // numeric or categorical
+	MaxFeatures int               `json:"max_features"` // vocabulary size limit for text columns
+	Search      Search            `json:"search"`       // candidate algorithms and parameters
+}
+
+// fitModel writes the training data in csv format, or svmlight format for sparse
+// data, to a temporary file, along with a json manifest describing the columns,
+// see fitManifest. Next it launches the fit.py in a child process, passing the
+// filename of the manifest and the location where the model should be saved as
+// arguments. Since we do not know the path the app will be run, we instruct
+// python to read the fit.py source from stdin instead of executing a file. This
+// would be equivalent to:
 //
-// 	$ python3 - < fit.py tmp.json models/model-id
+// 	$ python3 - < fit.py models/model-id tmp.json
 //
 // The source for fit.py as encoded as a raw/formatted string in the file
-// fit_py.go
+// fit_py.go, it is preceded by the source of transform.py (transform_py.go)
+// which defines the transformers used in the fitted pipelines.
 //
 // When the command completes, go checks the exit status, anything other than exit(0)
 // will result in a non-nil value for the error returned by cmd.Run().
-
-func fitModel(m *Model, d ModelReq, r *ModelRepo) {
+//
+// The schema used to parse the training data is saved to <model_id>.schema.json
+// in the model directory so that predict requests can be parsed the same way,
+// the profile of the training data is saved to <model_id>.profile.json, and the
+// fit configuration, along with a snapshot of the data when requested, is saved
+// so the model can be retrained, see FitConfig. The spooled dataset is removed
+// once fitModel returns, the model directory as well when the fit fails.
+func fitModel(m *Model, ds *Dataset, r *ModelRepo) {
 	log.Infof("started fitting model %v", m.ID)
+	defer ds.Remove()
+
+	err := os.MkdirAll(m.dir, 0755)
+	if err != nil {
+		log.Error("unable to create model directory ", err)
+		return
+	}
+	// remove the model directory unless the model is fitted, so a failed fit
+	// doesn't leave a partial model to be listed and loaded
+	fitted := false
+	defer func() {
+		if !fitted {
+			os.RemoveAll(m.dir)
+		}
+	}()
+
+	err = writeJSONFile(filepath.Join(m.dir, m.ID+".schema.json"), ds.Schema)
+	if err != nil {
+		log.Error("unable to save model schema ", err)
+		return
+	}
+
+	err = writeJSONFile(filepath.Join(m.dir, m.ID+".profile.json"), ds.DataProfile())
+	if err != nil {
+		log.Error("unable to save training data profile ", err)
+		return
+	}
+
+	cfg := ds.fitConfig()
+	if ds.Snapshot {
+		err = ds.writeSnapshot(m.dir, m.ID, &cfg)
+		if err != nil {
+			log.Error("unable to save training data snapshot ", err)
+			return
+		}
+	}
+	err = writeJSONFile(filepath.Join(m.dir, m.ID+".fit.json"), cfg)
+	if err != nil {
+		log.Error("unable to save fit configuration ", err)
+		return
+	}
+
 	// write data to temp file
 	f, err := ioutil.TempFile("", m.ID)
 	if err != nil {
@@ -38,21 +100,65 @@ func fitModel(m *Model, d ModelReq, r *ModelRepo) {
 	}
 	defer os.Remove(f.Name())
 
-	err = json.NewEncoder(f).Encode(d)
+	format := formatCSV
+	w := bufio.NewWriter(f)
+	if ds.Schema.Sparse {
+		format = formatSVMLight
+		err = ds.WriteSVMLight(w)
+	} else {
+		err = ds.WriteCSV(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
 	if err != nil {
-		log.Error("error encoding training data ", err)
+		log.Error("error writing training data ", err)
 		return
 	}
-	f.Close()
 
-	cmd := exec.Command("python3", "-", m.dir, f.Name())
-	cmd.Stdin = strings.NewReader(fitPy)
+	manifest := fitManifest{
+		Name:        ds.Name,
+		Data:        f.Name(),
+		Format:      format,
+		Types:       ds.Schema.featureTypes(),
+		LabelType:   typeCategorical,
+		MaxFeatures: ds.Schema.TextMaxFeatures,
+		Search:      ds.Search,
+	}
+	if ds.isRegression {
+		manifest.LabelType = typeNumeric
+	}
+
+	mf, err := ioutil.TempFile("", m.ID)
+	if err != nil {
+		log.Error("unable to open temp file for fitting model ", err)
+		return
+	}
+	mf.Close()
+	defer os.Remove(mf.Name())
+
+	err = writeJSONFile(mf.Name(), manifest)
+	if err != nil {
+		log.Error("error encoding training manifest ", err)
+		return
+	}
+
+	cmd := exec.Command("python3", "-", m.dir, mf.Name())
+	cmd.Stdin = strings.NewReader(transformPy + "\n" + fitPy)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	err = cmd.Run()
 	if err != nil {
 		log.Errorf("error fitting model %v: %v %v", m.ID, err.Error(), stderr.String())
+		return
+	}
+	fitted = true
+
+	err = m.persistAll()
+	if err != nil {
+		log.Errorf("error storing model %v: %v", m.ID, err.Error())
 	}
 
 	// load the model into the index after fitted
@@ -91,7 +197,7 @@ func startModel(m *Model) error {
 	fileName := fmt.Sprintf("%s.pkl", m.ID)
 
 	cmd := exec.Command("python3", "-", socketPath, filepath.Join(m.dir, fileName))
-	cmd.Stdin = strings.NewReader(predictPy)
+	cmd.Stdin = strings.NewReader(transformPy + "\n" + predictPy)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
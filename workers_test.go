@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFailedFitRemovesModelDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mlserver-models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without python3 on the path the fit fails after the schema, profile,
+	// and fit configuration are written
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	defer os.Setenv("PATH", path)
+
+	r := NewModelRepo(dir, nil)
+	m := r.NewModel()
+	ds := profileCSV(t, "label,x\na,1\nb,2\n", Schema{Target: "label"})
+	fitModel(m, ds, r)
+
+	if _, err := os.Stat(m.dir); !os.IsNotExist(err) {
+		t.Errorf("model directory left after a failed fit: %v", err)
+	}
+	if models := r.All(); len(models) != 0 {
+		t.Errorf("%d models loaded after a failed fit", len(models))
+	}
+}